@@ -37,6 +37,7 @@ func main() {
 	rand.Seed(time.Now().UTC().UnixNano())
 
 	command := app.NewCloudControllerManagerCommand()
+	command.AddCommand(newMigrateCommand())
 
 	logs.InitLogs()
 	defer logs.FlushLogs()
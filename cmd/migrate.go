@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+	"netlox.io/netlox/pkg/cloudprovider/netlox"
+)
+
+// newMigrateCommand returns the command moving the services recorded in the netlox configMaps to
+// LoxiLoadBalancers
+func newMigrateCommand() *cobra.Command {
+	var kubeconfig string
+	opts := netlox.MigrateOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Move the services recorded in the netlox configMaps to LoxiLoadBalancers",
+		Long: `Move the services recorded in the netlox-services key of the netlox configMap of every namespace
+to LoxiLoadBalancers, keeping their VIPs. Every record is verified against its live Service first, records
+of Services that are gone or whose status has other VIPs are reported and left in the configMap.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+			if err != nil {
+				return fmt.Errorf("error creating kubernetes client config: %s", err.Error())
+			}
+			kubeClient, err := kubernetes.NewForConfig(config)
+			if err != nil {
+				return fmt.Errorf("error creating kubernetes client: %s", err.Error())
+			}
+			client, err := dynamic.NewForConfig(config)
+			if err != nil {
+				return fmt.Errorf("error creating kubernetes dynamic client: %s", err.Error())
+			}
+
+			result, err := netlox.Migrate(context.TODO(), kubeClient, client, opts, os.Stdout)
+			if result != nil {
+				verb := "migrated"
+				if opts.DryRun {
+					verb = "would be migrated"
+				}
+				fmt.Printf("# %d services %s, %d skipped\n", result.Migrated, verb, result.Skipped)
+			}
+			return err
+		},
+	}
+	cmd.Flags().StringVar(&kubeconfig, "kubeconfig", "", "Path to a kubeconfig, the in-cluster config is used when empty")
+	cmd.Flags().StringVar(&opts.ConfigMap, "configmap", netlox.NetloxClientConfig, "Name of the netlox configMap of every namespace")
+	cmd.Flags().BoolVar(&opts.DryRun, "dry-run", false, "Print the changes as a diff without making them")
+
+	// The controller manager help lists its own flags, which migrate doesn't take
+	cmd.SetUsageFunc(func(cmd *cobra.Command) error {
+		fmt.Fprintf(cmd.OutOrStderr(), "Usage:\n  %s\n\nFlags:\n%s", cmd.UseLine(), cmd.LocalFlags().FlagUsages())
+		return nil
+	})
+	cmd.SetHelpFunc(func(cmd *cobra.Command, args []string) {
+		fmt.Fprintf(cmd.OutOrStdout(), "%s\n\n", cmd.Long)
+		cmd.Usage()
+	})
+	return cmd
+}
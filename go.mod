@@ -3,7 +3,12 @@ module netlox.io/netlox
 go 1.13
 
 require (
-	github.com/plunder-app/plndr-cloud-provider v0.0.0-20210419084012-9eb45d26dba4
+	github.com/NYTimes/gziphandler v1.0.1 // indirect
+	github.com/coreos/pkg v0.0.0-20180928190104-399ea9e2e55f // indirect
+	github.com/golang/groupcache v0.0.0-20180513044358-24b0969c4cb7 // indirect
+	github.com/googleapis/gnostic v0.2.0 // indirect
+	github.com/spf13/cobra v0.0.5
+	github.com/tmc/grpc-websocket-proxy v0.0.0-20190109142713-0ad062ec5ee5 // indirect
 	k8s.io/api v0.18.0
 	k8s.io/apimachinery v0.18.0
 	k8s.io/client-go v0.18.0
@@ -11,6 +16,7 @@ require (
 	k8s.io/component-base v0.18.0
 	k8s.io/klog v1.0.0
 	k8s.io/kubernetes v1.18.0
+	sigs.k8s.io/yaml v1.2.0
 )
 
 replace (
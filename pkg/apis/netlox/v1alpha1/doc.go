@@ -0,0 +1,4 @@
+// Package v1alpha1 contains the netlox.io/v1alpha1 API types
+// +k8s:deepcopy-gen=package
+// +groupName=netlox.io
+package v1alpha1
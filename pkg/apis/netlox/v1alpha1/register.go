@@ -0,0 +1,37 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// GroupName is the API group of the netlox resources
+const GroupName = "netlox.io"
+
+// SchemeGroupVersion is the group version of the types in this package
+var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1alpha1"}
+
+// LoxiIPPoolResource is the resource of the LoxiIPPool type, as used by the dynamic client
+var LoxiIPPoolResource = SchemeGroupVersion.WithResource("loxiippools")
+
+// LoxiLoadBalancerResource is the resource of the LoxiLoadBalancer type, as used by the dynamic client
+var LoxiLoadBalancerResource = SchemeGroupVersion.WithResource("loxiloadbalancers")
+
+var (
+	// SchemeBuilder registers the types in this package
+	SchemeBuilder = runtime.NewSchemeBuilder(addKnownTypes)
+	// AddToScheme adds the types in this package to a scheme
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+func addKnownTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(SchemeGroupVersion,
+		&LoxiIPPool{},
+		&LoxiIPPoolList{},
+		&LoxiLoadBalancer{},
+		&LoxiLoadBalancerList{},
+	)
+	metav1.AddToGroupVersion(scheme, SchemeGroupVersion)
+	return nil
+}
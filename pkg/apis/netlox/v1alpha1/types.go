@@ -0,0 +1,133 @@
+package v1alpha1
+
+import (
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// LoxiIPPool is a (cluster wide) pool of addresses that LoadBalancer services are given their VIPs from
+type LoxiIPPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   LoxiIPPoolSpec   `json:"spec"`
+	Status LoxiIPPoolStatus `json:"status,omitempty"`
+}
+
+// LoxiIPPoolSpec describes the addresses of a pool and the services that use it
+type LoxiIPPoolSpec struct {
+	// CIDRs of the pool, the network and broadcast addresses of IPv4 cidrs aren't handed out
+	CIDRs []string `json:"cidrs,omitempty"`
+	// Ranges of the pool as start-end addresses
+	Ranges []string `json:"ranges,omitempty"`
+	// Exclude lists addresses, cidrs or start-end ranges of the pool that are never handed out
+	Exclude []string `json:"exclude,omitempty"`
+	// NamespaceSelector selects the namespaces whose services use the pool, nil selects every namespace
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// ServiceSelector selects the services that use the pool, nil selects every service
+	ServiceSelector *metav1.LabelSelector `json:"serviceSelector,omitempty"`
+	// Strategy is how addresses are picked, one of lowest-free (the default), random or round-robin
+	Strategy string `json:"strategy,omitempty"`
+	// AddressFamily limits the pool to IPv4 or IPv6 addresses, empty allows both
+	AddressFamily v1.IPFamily `json:"addressFamily,omitempty"`
+}
+
+// LoxiIPPoolStatus reports the usage of a pool, the counts are capped at the largest int64
+type LoxiIPPoolStatus struct {
+	Capacity int64 `json:"capacity"`
+	Used     int64 `json:"used"`
+	Free     int64 `json:"free"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// LoxiIPPoolList is a list of LoxiIPPools
+type LoxiIPPoolList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []LoxiIPPool `json:"items"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// LoxiLoadBalancer records the load balancer of a LoadBalancer Service, it is named after the Service (in
+// its namespace) and owned by it
+type LoxiLoadBalancer struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   LoxiLoadBalancerSpec   `json:"spec"`
+	Status LoxiLoadBalancerStatus `json:"status,omitempty"`
+}
+
+// LoxiLoadBalancerSpec describes the Service a load balancer is for
+type LoxiLoadBalancerSpec struct {
+	// ServiceUID is the UID of the Service, a Service recreated with the same name gets a new load balancer
+	ServiceUID types.UID `json:"serviceUID"`
+	// Pool is the named pool the VIPs were allocated from, empty for the pool of the namespace
+	Pool string `json:"pool,omitempty"`
+	// Ports are the Service ports exposed on the VIPs
+	Ports []LoxiLoadBalancerPort `json:"ports,omitempty"`
+}
+
+// LoxiLoadBalancerPort is a Service port exposed on the VIPs and the nodePort it is forwarded to
+type LoxiLoadBalancerPort struct {
+	Port     int32       `json:"port"`
+	NodePort int32       `json:"nodePort"`
+	Protocol v1.Protocol `json:"protocol"`
+}
+
+// LoxiLoadBalancerStatus reports the addresses of a load balancer and where it is programmed
+type LoxiLoadBalancerStatus struct {
+	// VIPs are the addresses of the load balancer, one per IP family with the primary family first
+	VIPs []string `json:"vips,omitempty"`
+	// Nodes are the LoxiLB nodes the load balancer is programmed on
+	Nodes []string `json:"nodes,omitempty"`
+	// Rules are the rules programmed on every LoxiLB, rules that couldn't be removed are kept until they are
+	Rules      []LoxiLoadBalancerRule      `json:"rules,omitempty"`
+	Conditions []LoxiLoadBalancerCondition `json:"conditions,omitempty"`
+}
+
+// LoxiLoadBalancerRule is a VIP and port programmed on a single LoxiLB
+type LoxiLoadBalancerRule struct {
+	// ID identifies the rule amongst the rules of the load balancer, as <loxilb>/<vip>/<port>/<protocol>
+	ID string `json:"id"`
+	// LoxiLB is the address of the LoxiLB API the rule was programmed through
+	LoxiLB string `json:"loxilb"`
+	// Node is the name of the node running that LoxiLB
+	Node     string      `json:"node,omitempty"`
+	VIP      string      `json:"vip"`
+	Port     int32       `json:"port"`
+	Protocol v1.Protocol `json:"protocol"`
+	// Endpoints are the "address:port" backends the rule forwards to
+	Endpoints []string `json:"endpoints,omitempty"`
+}
+
+// LoxiLoadBalancerConditionType is a condition of a load balancer
+type LoxiLoadBalancerConditionType string
+
+// LoxiLoadBalancerProgrammed is true once every LoxiLB node has the rules of the load balancer
+const LoxiLoadBalancerProgrammed LoxiLoadBalancerConditionType = "Programmed"
+
+// LoxiLoadBalancerCondition is the state of a load balancer condition
+type LoxiLoadBalancerCondition struct {
+	Type               LoxiLoadBalancerConditionType `json:"type"`
+	Status             v1.ConditionStatus            `json:"status"`
+	LastTransitionTime metav1.Time                   `json:"lastTransitionTime,omitempty"`
+	Reason             string                        `json:"reason,omitempty"`
+	Message            string                        `json:"message,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// LoxiLoadBalancerList is a list of LoxiLoadBalancers
+type LoxiLoadBalancerList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []LoxiLoadBalancer `json:"items"`
+}
@@ -0,0 +1,191 @@
+package netlox
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"netlox.io/netlox/pkg/ipam"
+)
+
+// addressAllocator hands out the VIPs of the pools, it is implemented by the ipam.Allocator
+type addressAllocator interface {
+	// Allocate returns a free address of the family from the pool, marking it as allocated to the owner
+	Allocate(p ipam.Pool, family ipam.Family, owner string) (string, error)
+	// AllocateSpecific marks the address as allocated to the owner, checking it is part of the pool (if one
+	// is passed)
+	AllocateSpecific(address string, p *ipam.Pool, owner string) error
+	// InPool returns true if the address is one of the pool addresses
+	InPool(address string, p ipam.Pool) (bool, error)
+	// Excluded returns true if the address is excluded from the pool
+	Excluded(address string, p ipam.Pool) (bool, error)
+	// Release frees an allocated address
+	Release(address string) error
+	// IsAllocated returns true if the address is allocated
+	IsAllocated(address string) bool
+	// Owner returns the owner the address is allocated to, false if it isn't allocated
+	Owner(address string) (string, bool)
+	// Usage returns the number of addresses the pool can hand out and how many are allocated
+	Usage(p ipam.Pool) (capacity, used *big.Int, err error)
+	// Allocated returns the owner of every allocated address of the pool
+	Allocated(p ipam.Pool) (map[string]string, error)
+}
+
+var _ addressAllocator = &ipam.Allocator{}
+
+// allocationOwner is the owner the addresses of a service are allocated to, <namespace>/<uid>, so that the
+// allocations can be told apart by namespace
+func allocationOwner(namespace string, uid types.UID) string {
+	return fmt.Sprintf("%s/%s", namespace, uid)
+}
+
+// serviceOwner is the owner the addresses of the service are allocated to
+func serviceOwner(service *v1.Service) string {
+	return allocationOwner(service.Namespace, service.UID)
+}
+
+// ownerNamespace returns the namespace of the service an address is allocated to
+func ownerNamespace(owner string) string {
+	if x := strings.Index(owner, "/"); x >= 0 {
+		return owner[:x]
+	}
+	return ""
+}
+
+// rebuildAllocations marks every address already in use as allocated to its service, so that a restarted
+// controller doesn't hand out a VIP that belongs to an existing service. The addresses are taken from the
+// status (and spec) of every LoadBalancer service and from the recorded services. It must complete before
+// any address is allocated. An address in use that is excluded from its pool is kept but logged, the
+// service will need a new address.
+func (lb *loadbalancers) rebuildAllocations(ctx context.Context) error {
+	// owners are the services using the addresses (see allocationOwner), in the order they are found
+	var addresses, owners []string
+
+	// The pools are only needed to check for excluded addresses
+	controllerCM, err := lb.GetConfigMap(ctx, NetloxCloudConfig, "kube-system")
+	if err != nil {
+		klog.Warningf("Unable to retrieve netlox ipam config from configMap [%s] in kube-system, excluded addresses aren't checked : %v", NetloxCloudConfig, err)
+		controllerCM = nil
+	}
+
+	svcs, err := lb.kubeClient.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("Unable to list services : %v", err)
+	}
+	for x := range svcs.Items {
+		service := &svcs.Items[x]
+		if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		var inUse []string
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if ingress.IP != "" {
+				inUse = append(inUse, ingress.IP)
+			}
+		}
+		if service.Spec.LoadBalancerIP != "" && (len(inUse) == 0 || inUse[0] != service.Spec.LoadBalancerIP) {
+			inUse = append(inUse, service.Spec.LoadBalancerIP)
+		}
+		lb.warnExcludedAddresses(ctx, controllerCM, service, inUse)
+		for _, address := range inUse {
+			addresses = append(addresses, address)
+			owners = append(owners, serviceOwner(service))
+		}
+	}
+
+	recorded, err := lb.store.list(ctx)
+	if err != nil {
+		return err
+	}
+	for x := range recorded {
+		for _, address := range recorded[x].vips() {
+			addresses = append(addresses, address)
+			owners = append(owners, allocationOwner(recorded[x].Namespace, types.UID(recorded[x].UID)))
+		}
+	}
+
+	var reserved int
+	for x, address := range addresses {
+		if owner, ok := lb.allocator.Owner(address); ok {
+			if owner != owners[x] {
+				klog.Warningf("Address [%s] is used by services [%s] and [%s], it stays allocated to [%s]", address, owner, owners[x], owner)
+			}
+			continue
+		}
+		if err := lb.allocator.AllocateSpecific(address, nil, owners[x]); err != nil {
+			klog.Errorf("Unable to mark address [%s] as allocated : %v", address, err)
+			continue
+		}
+		reserved++
+	}
+	klog.Infof("Rebuilt address allocations, [%d] addresses are in use", reserved)
+	lb.updatePoolUsage(ctx)
+	return nil
+}
+
+// warnExcludedAddresses logs the addresses of a service that are excluded from its pool
+func (lb *loadbalancers) warnExcludedAddresses(ctx context.Context, cm *v1.ConfigMap, service *v1.Service, addresses []string) {
+	for _, address := range addresses {
+		family, err := ipam.FamilyOf(address)
+		if err != nil {
+			continue
+		}
+		pool, err := lb.servicePool(ctx, cm, service, family)
+		if err != nil {
+			continue
+		}
+		excluded, err := lb.allocator.Excluded(address, *pool)
+		if err != nil {
+			klog.Warningf("Unable to check if address [%s] of service [%s/%s] is excluded : %v", address, service.Namespace, service.Name, err)
+			continue
+		}
+		if excluded {
+			klog.Warningf("Address [%s] of service [%s/%s] is excluded from pool [%s]", address, service.Namespace, service.Name, pool.Name)
+		}
+	}
+}
+
+// reserveRequestedAddress validates and reserves the address requested through spec.loadBalancerIP,
+// returning it in its canonical form. The address must belong to the pool of the service (unless the
+// service is annotated to allow an address outside of the pools) and mustn't be allocated to any other
+// service. The allocations include every address in use by a service (see rebuildAllocations).
+func (lb *loadbalancers) reserveRequestedAddress(ctx context.Context, cm *v1.ConfigMap, service *v1.Service) (string, error) {
+	ip := net.ParseIP(service.Spec.LoadBalancerIP)
+	if ip == nil {
+		return "", fmt.Errorf("Requested loadBalancerIP [%s] isn't a valid address", service.Spec.LoadBalancerIP)
+	}
+	address := ip.String()
+
+	if service.Annotations[outsidePoolAnnotation] == "true" {
+		klog.Infof("Service [%s] is allowed an address outside of the pools, skipping the pool check for [%s]", service.Name, address)
+	} else {
+		family, _ := ipam.FamilyOf(address)
+		pool, err := lb.servicePool(ctx, cm, service, family)
+		if err != nil {
+			return "", fmt.Errorf("Requested loadBalancerIP [%s] can't be validated : %v", address, err)
+		}
+		inPool, err := lb.allocator.InPool(address, *pool)
+		if err != nil {
+			return "", err
+		}
+		if !inPool {
+			return "", fmt.Errorf("Requested loadBalancerIP [%s] isn't part of pool [%s], set the annotation [%s: \"true\"] to allow it", address, pool.Name, outsidePoolAnnotation)
+		}
+	}
+
+	// The address may already be allocated to this service (e.g. by the allocations rebuilt on startup),
+	// but not to another one
+	if owner, ok := lb.allocator.Owner(address); ok {
+		if owner != serviceOwner(service) {
+			return "", fmt.Errorf("Requested loadBalancerIP [%s] is already used by service [%s]", address, owner)
+		}
+		return address, nil
+	}
+	return address, lb.allocator.AllocateSpecific(address, nil, serviceOwner(service))
+}
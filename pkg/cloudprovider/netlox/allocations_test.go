@@ -0,0 +1,269 @@
+package netlox
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"netlox.io/netlox/pkg/ipam"
+)
+
+func TestRebuildAllocations(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	withStatus := testService("with-status", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	withStatus.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "192.168.0.1"}}
+	clusterIP := testService("cluster-ip", v1.ServicePort{Port: 80, Protocol: v1.ProtocolTCP})
+	clusterIP.Spec.Type = v1.ServiceTypeClusterIP
+	clusterIP.Spec.LoadBalancerIP = "192.168.0.9"
+	recorded := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: NetloxClientConfig, Namespace: "team-a"},
+		Data: map[string]string{
+			NetloxServicesKey: `{"services":[{"vip":"192.168.0.2","uid":"a","serviceName":"a"}]}`,
+		},
+	}
+	lb, _ := newTestLoadBalancers(f, withStatus, clusterIP, recorded)
+
+	if err := lb.rebuildAllocations(context.Background()); err != nil {
+		t.Fatalf("rebuildAllocations() error = %v", err)
+	}
+	for _, address := range []string{"192.168.0.1", "192.168.0.2"} {
+		if !lb.allocator.IsAllocated(address) {
+			t.Errorf("address [%s] in use isn't allocated", address)
+		}
+	}
+	if lb.allocator.IsAllocated("192.168.0.9") {
+		t.Errorf("address of a non LoadBalancer service was allocated")
+	}
+
+	// The next service mustn't be handed an address that is in use
+	svc := testService("next", v1.ServicePort{Port: 80, NodePort: 30081, Protocol: v1.ProtocolTCP})
+	lb.kubeClient.CoreV1().Services(svc.Namespace).Create(context.Background(), svc, metav1.CreateOptions{})
+	status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nil)
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	if ip := status.Ingress[0].IP; ip != "192.168.0.3" {
+		t.Errorf("EnsureLoadBalancer() allocated [%s], want 192.168.0.3", ip)
+	}
+}
+
+func TestEnsureLoadBalancer_requestedAddress(t *testing.T) {
+	other := testService("other", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	other.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "192.168.0.20"}, {IP: "2001:db8::1"}}
+
+	tests := []struct {
+		name        string
+		address     string
+		annotations map[string]string
+		wantReason  string
+	}{
+		{
+			name:    "address in pool",
+			address: "192.168.0.10",
+		},
+		{
+			name:       "address used by another service",
+			address:    "192.168.0.20",
+			wantReason: "LoadBalancerIPRejected",
+		},
+		{
+			name:        "address used by another service, not in canonical form",
+			address:     "2001:0db8:0::1",
+			annotations: map[string]string{outsidePoolAnnotation: "true"},
+			wantReason:  "LoadBalancerIPRejected",
+		},
+		{
+			name:       "address outside of the pool",
+			address:    "10.10.0.1",
+			wantReason: "LoadBalancerIPRejected",
+		},
+		{
+			name:        "address outside of the pool allowed",
+			address:     "10.10.0.1",
+			annotations: map[string]string{outsidePoolAnnotation: "true"},
+		},
+		{
+			name:       "invalid address",
+			address:    "10.10.0",
+			wantReason: "LoadBalancerIPRejected",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeLoxiLB()
+			defer f.Close()
+
+			svc := testService("requested", v1.ServicePort{Port: 80, NodePort: 30081, Protocol: v1.ProtocolTCP})
+			lb, _ := newTestLoadBalancers(f, svc, other.DeepCopy())
+			if err := lb.rebuildAllocations(context.Background()); err != nil {
+				t.Fatalf("rebuildAllocations() error = %v", err)
+			}
+			svc.Spec.LoadBalancerIP = tt.address
+			svc.Annotations = tt.annotations
+
+			status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nil)
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Fatalf("EnsureLoadBalancer() error = %v", err)
+				}
+				if status.Ingress[0].IP != tt.address || !lb.allocator.IsAllocated(tt.address) {
+					t.Errorf("EnsureLoadBalancer() = %v, want the requested address reserved", status.Ingress)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("EnsureLoadBalancer() expected an error")
+			}
+			select {
+			case event := <-lb.recorder.(*record.FakeRecorder).Events:
+				if !strings.Contains(event, tt.wantReason) {
+					t.Errorf("event = %s, want %s", event, tt.wantReason)
+				}
+			default:
+				t.Errorf("no event was recorded on the service")
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancer_sameRequestedAddress(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	first := testService("first", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	second := testService("second", v1.ServicePort{Port: 80, NodePort: 30081, Protocol: v1.ProtocolTCP})
+	// Neither service has the address in its status yet, only the allocator knows who it was handed to
+	lb, _ := newTestLoadBalancers(f, first, second)
+
+	first.Spec.LoadBalancerIP = "192.168.0.10"
+	second.Spec.LoadBalancerIP = "192.168.0.10"
+	if _, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", first.DeepCopy(), nil); err != nil {
+		t.Fatalf("EnsureLoadBalancer(first) error = %v", err)
+	}
+	if _, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", second.DeepCopy(), nil); err == nil {
+		t.Fatalf("EnsureLoadBalancer(second) expected an error for the address of first")
+	}
+	if owner, _ := lb.allocator.Owner("192.168.0.10"); owner != serviceOwner(first) {
+		t.Errorf("address is allocated to [%s], want first", owner)
+	}
+	if entry := findTestService(t, lb, second); entry != nil {
+		t.Errorf("second is recorded with the address of first: %+v", entry)
+	}
+
+	// The owner can still reserve its address again
+	cm, err := lb.GetConfigMap(context.Background(), NetloxCloudConfig, "kube-system")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lb.reserveRequestedAddress(context.Background(), cm, first); err != nil {
+		t.Errorf("reserveRequestedAddress(first) error = %v", err)
+	}
+}
+
+// fakeAllocator hands out the addresses it is given in order and records what is released
+type fakeAllocator struct {
+	addresses []string
+	allocated map[string]string
+	released  []string
+}
+
+func (a *fakeAllocator) Allocate(p ipam.Pool, family ipam.Family, owner string) (string, error) {
+	if len(a.addresses) == 0 {
+		return "", fmt.Errorf("No %s addresses available in pool [%s]", family, p.Name)
+	}
+	address := a.addresses[0]
+	a.addresses = a.addresses[1:]
+	a.allocated[address] = owner
+	return address, nil
+}
+
+func (a *fakeAllocator) AllocateSpecific(address string, p *ipam.Pool, owner string) error {
+	a.allocated[address] = owner
+	return nil
+}
+
+func (a *fakeAllocator) InPool(address string, p ipam.Pool) (bool, error) {
+	return true, nil
+}
+
+func (a *fakeAllocator) Excluded(address string, p ipam.Pool) (bool, error) {
+	return false, nil
+}
+
+func (a *fakeAllocator) Release(address string) error {
+	delete(a.allocated, address)
+	a.released = append(a.released, address)
+	return nil
+}
+
+func (a *fakeAllocator) IsAllocated(address string) bool {
+	_, ok := a.allocated[address]
+	return ok
+}
+
+func (a *fakeAllocator) Owner(address string) (string, bool) {
+	owner, ok := a.allocated[address]
+	return owner, ok
+}
+
+func (a *fakeAllocator) Allocated(p ipam.Pool) (map[string]string, error) {
+	allocated := map[string]string{}
+	for address, owner := range a.allocated {
+		allocated[address] = owner
+	}
+	return allocated, nil
+}
+
+func (a *fakeAllocator) Usage(p ipam.Pool) (*big.Int, *big.Int, error) {
+	return big.NewInt(int64(len(a.addresses) + len(a.allocated))), big.NewInt(int64(len(a.allocated))), nil
+}
+
+func TestEnsureLoadBalancer_allocator(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	svc := testService("web", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	lb, kubeClient := newTestLoadBalancers(f, svc)
+	allocator := &fakeAllocator{addresses: []string{"10.10.10.10", "10.10.10.11"}, allocated: map[string]string{}}
+	lb.allocator = allocator
+
+	// The address is handed back when the service can't be recorded
+	kubeClient.PrependReactor("*", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetVerb() != "create" && action.GetVerb() != "update" {
+			return false, nil, nil
+		}
+		return true, nil, fmt.Errorf("fake update failure")
+	})
+	if _, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc.DeepCopy(), nil); err == nil {
+		t.Fatalf("EnsureLoadBalancer() expected an error")
+	}
+	if want := []string{"10.10.10.10"}; !reflect.DeepEqual(allocator.released, want) {
+		t.Errorf("released = %v, want %v", allocator.released, want)
+	}
+
+	kubeClient.ReactionChain = kubeClient.ReactionChain[1:]
+	status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc.DeepCopy(), nil)
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	if vip := status.Ingress[0].IP; vip != "10.10.10.11" {
+		t.Errorf("EnsureLoadBalancer() vip = %s, want the allocator address 10.10.10.11", vip)
+	}
+	// The service is read-only, its address is only returned in the status
+	for _, action := range kubeClient.Actions() {
+		if action.GetResource().Resource == "services" && action.GetVerb() == "update" {
+			t.Errorf("EnsureLoadBalancer() updated the service: %+v", action)
+		}
+	}
+}
@@ -1,10 +1,39 @@
 package netlox
 
 import (
+	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"time"
+
+	"netlox.io/netlox/pkg/loxilb"
 )
 
+// netloxClient builds the clients used to talk to the LoxiLB API running on each load balancer node
+type netloxClient struct {
+	httpClient *http.Client
+	port       int
+}
+
 // newnetloxClient returns a specific HTTP client used when communicating with the netlox API(s)
-func newnetloxClient() *http.Client {
-	return &http.Client{}
+func newnetloxClient(port int) *netloxClient {
+	if port == 0 {
+		port = loxilb.DefaultPort
+	}
+	return &netloxClient{
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+		port: port,
+	}
+}
+
+// loxiLB returns a client for the LoxiLB API listening on the node address
+func (c *netloxClient) loxiLB(address string) (*loxilb.Client, error) {
+	if address == "" {
+		return nil, fmt.Errorf("No address to reach LoxiLB")
+	}
+	endpoint := fmt.Sprintf("http://%s", net.JoinHostPort(address, strconv.Itoa(c.port)))
+	return loxilb.NewClient(endpoint, c.httpClient)
 }
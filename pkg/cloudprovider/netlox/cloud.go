@@ -1,17 +1,25 @@
 package netlox
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog"
+	"netlox.io/netlox/pkg/apis/netlox/v1alpha1"
+	"netlox.io/netlox/pkg/ipam"
 )
 
 // OutSideCluster allows the controller to be started using a local kubeConfig for testing
@@ -20,10 +28,13 @@ var OutSideCluster bool
 // The netlox cloud provider implementation. Encapsulates a client to talk to our cloud provider
 // and the interfaces needed to satisfy the cloudprovider.Interface interface.
 type netlox struct {
-	providerName string
-	// instances     cloudprovider.Instances
-	// zones         cloudprovider.Zones
-	loadbalancers cloudprovider.LoadBalancer
+	providerName      string
+	instances         *instances
+	zones             *zones
+	routes            *routes
+	loadbalancers     *loadbalancers
+	ipPools           *ipPools
+	loxiLoadBalancers *loxiLoadBalancers
 }
 
 const (
@@ -52,6 +63,13 @@ func newCloud() (cloudprovider.Interface, error) {
 	ns := os.Getenv("NETLOX_NAMESPACE")
 	cm := os.Getenv("NETLOX_CONFIG_MAP")
 	cidr := os.Getenv("NETLOX_SERVICE_CIDR")
+	loxiPort := os.Getenv("NETLOX_LOXILB_PORT")
+	inventoryFile := os.Getenv("NETLOX_INVENTORY_FILE")
+	inventoryCM := os.Getenv("NETLOX_INVENTORY_CONFIG_MAP")
+	redfishUsername := os.Getenv("NETLOX_REDFISH_USERNAME")
+	redfishPassword := os.Getenv("NETLOX_REDFISH_PASSWORD")
+	redfishInsecure := os.Getenv("NETLOX_REDFISH_INSECURE") == "true"
+	zoneSources := os.Getenv("NETLOX_ZONE_SOURCES")
 
 	if cm == "" {
 		cm = NetloxCloudConfig
@@ -61,42 +79,88 @@ func newCloud() (cloudprovider.Interface, error) {
 		ns = "default"
 	}
 
-	var cl *kubernetes.Clientset
-	if OutSideCluster == false {
-		// This will attempt to load the configuration when running within a POD
-		cfg, err := rest.InClusterConfig()
+	var port int
+	if loxiPort != "" {
+		var err error
+		port, err = strconv.Atoi(loxiPort)
 		if err != nil {
-			klog.Error("error creating kubernetes client config: %s", err.Error())
-			return nil, fmt.Errorf("error creating kubernetes client config: %s", err.Error())
+			return nil, fmt.Errorf("error parsing NETLOX_LOXILB_PORT [%s]: %s", loxiPort, err.Error())
 		}
-		cl, err = kubernetes.NewForConfig(cfg)
+	}
+
+	sources, err := parseZoneSources(zoneSources)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing NETLOX_ZONE_SOURCES [%s]: %s", zoneSources, err.Error())
+	}
 
+	var config *rest.Config
+	if OutSideCluster == false {
+		// This will attempt to load the configuration when running within a POD
+		config, err = rest.InClusterConfig()
 		if err != nil {
-			klog.Error("error creating kubernetes client: %s", err.Error())
-			return nil, fmt.Errorf("error creating kubernetes client: %s", err.Error())
+			klog.Errorf("error creating kubernetes client config: %s", err.Error())
+			return nil, fmt.Errorf("error creating kubernetes client config: %s", err.Error())
 		}
 		// use the current context in kubeconfig
 	} else {
-		config, err := clientcmd.BuildConfigFromFlags("", filepath.Join(os.Getenv("HOME"), ".kube", "config"))
+		config, err = clientcmd.BuildConfigFromFlags("", filepath.Join(os.Getenv("HOME"), ".kube", "config"))
 		if err != nil {
 			panic(err.Error())
 		}
-		cl, err = kubernetes.NewForConfig(config)
-
-		if err != nil {
-			klog.Error("error creating kubernetes client: %s", err.Error())
-			return nil, fmt.Errorf("error creating kubernetes client: %s", err.Error())
-		}
+	}
+	cl, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		klog.Errorf("error creating kubernetes client: %s", err.Error())
+		return nil, fmt.Errorf("error creating kubernetes client: %s", err.Error())
+	}
+	dyn, err := dynamic.NewForConfig(config)
+	if err != nil {
+		klog.Errorf("error creating kubernetes dynamic client: %s", err.Error())
+		return nil, fmt.Errorf("error creating kubernetes dynamic client: %s", err.Error())
 	}
 
 	// Bootstrap HTTP client here
-	// cc := newnetloxClient()
+	cc := newnetloxClient(port)
+	allocator := ipam.NewAllocator()
+	lbs := newLoadBalancers(cl, cc, allocator, ns, cm, cidr)
 
-	return &netlox{
-		// instances:     newInstances(cc),
-		// zones:         newZones(cc),
-		loadbalancers: newLoadBalancers(cl, ns, cm, cidr),
-	}, nil
+	c := &netlox{
+		routes:            newRoutes(cl, cc),
+		loadbalancers:     lbs,
+		ipPools:           newIPPools(cl, dyn, allocator),
+		loxiLoadBalancers: newLoxiLoadBalancers(dyn, lbs.store, lbs.releaseRecord),
+	}
+	// The instances are read from the inventory file when one is set, or else the inventory configMap.
+	// Without either Instances isn't enabled, as the nodes it doesn't know would be deleted.
+	var inv inventory
+	if inventoryFile != "" {
+		inv = &fileInventory{path: inventoryFile}
+	} else if inventoryCM != "" {
+		inv = &configMapInventory{kubeClient: cl, namespace: "kube-system", name: inventoryCM}
+	}
+	if inv != nil {
+		c.instances = newInstances(inv, newRedfishPower(redfishUsername, redfishPassword, redfishInsecure))
+	} else {
+		klog.Infof("Neither NETLOX_INVENTORY_FILE nor NETLOX_INVENTORY_CONFIG_MAP is set, Instances isn't enabled")
+	}
+	// The load balancer prefers the endpoints in the zone of each LoxiLB node
+	c.zones = newZones(cl, c.instances, sources)
+	lbs.zones = c.zones
+	return c, nil
+}
+
+// resourceInstalled returns true if the (CRD) resource is served by the cluster
+func resourceInstalled(kubeClient kubernetes.Interface, resource schema.GroupVersionResource) bool {
+	resources, err := kubeClient.Discovery().ServerResourcesForGroupVersion(resource.GroupVersion().String())
+	if err != nil {
+		return false
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == resource.Resource {
+			return true
+		}
+	}
+	return false
 }
 
 // Note that all methods below makes netlox satisfy the cloudprovider.Interface interface!
@@ -107,6 +171,38 @@ func (c *netlox) Initialize(clientBuilder cloudprovider.ControllerClientBuilder,
 	// Start your own controllers here
 	klog.V(5).Info("Initialize()")
 
+	// The LoxiIPPools are optional, without the CRD only the pools of the netlox configMap are used
+	if c.ipPools.installed() {
+		if c.ipPools.start(stop) {
+			c.loadbalancers.ipPools = c.ipPools
+		} else {
+			klog.Errorf("LoxiIPPools weren't synced, only the configMap pools are used")
+		}
+	} else {
+		klog.Infof("The LoxiIPPool CRD isn't installed, only the configMap pools are used")
+	}
+
+	// The LoxiLoadBalancers are optional too, without the CRD the services are recorded in the netlox
+	// configMap of their namespace
+	if resourceInstalled(c.loadbalancers.kubeClient, v1alpha1.LoxiLoadBalancerResource) {
+		c.loadbalancers.store = c.loxiLoadBalancers
+	} else {
+		klog.Infof("The LoxiLoadBalancer CRD isn't installed, services are recorded in the [%s] configMaps", NetloxClientConfig)
+	}
+
+	// Addresses already in use must be known before the service controller allocates any, so keep
+	// retrying until the allocations are rebuilt (or we are stopped)
+	err := wait.PollImmediateUntil(5*time.Second, func() (bool, error) {
+		if err := c.loadbalancers.rebuildAllocations(context.TODO()); err != nil {
+			klog.Errorf("Unable to rebuild address allocations, retrying : %v", err)
+			return false, nil
+		}
+		return true, nil
+	}, stop)
+	if err != nil {
+		klog.Errorf("Address allocations weren't rebuilt : %v", err)
+	}
+
 	clientset := clientBuilder.ClientOrDie("do-shared-informers")
 	sharedInformer := informers.NewSharedInformerFactory(clientset, 0)
 
@@ -123,16 +219,18 @@ func (c *netlox) LoadBalancer() (cloudprovider.LoadBalancer, bool) {
 	return c.loadbalancers, true
 }
 
+// Instances are enabled when an inventory is configured
 func (c *netlox) Instances() (cloudprovider.Instances, bool) {
 	klog.V(5).Info("Instances()")
-	// return c.instances, true
-	return nil, false
+	if c.instances == nil {
+		return nil, false
+	}
+	return c.instances, true
 }
 
 func (c *netlox) Zones() (cloudprovider.Zones, bool) {
 	klog.V(5).Info("Zones()")
-	// return c.zones, true
-	return nil, false
+	return c.zones, true
 }
 
 // Clusters is not implemented
@@ -140,9 +238,10 @@ func (c *netlox) Clusters() (cloudprovider.Clusters, bool) {
 	return nil, false
 }
 
-// Routes is not implemented
+// Routes programs the pod CIDRs of the nodes on the LoxiLB nodes
 func (c *netlox) Routes() (cloudprovider.Routes, bool) {
-	return nil, false
+	klog.V(5).Info("Routes()")
+	return c.routes, true
 }
 
 // ProviderName returns this cloud providers name
@@ -3,36 +3,69 @@ package netlox
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
 )
 
+// serviceStore records the VIPs and LoxiLB rules of the load balancer services
+type serviceStore interface {
+	// get returns the record of the service, nil if it has none
+	get(ctx context.Context, service *v1.Service) (*services, error)
+	// save records the service, syncErr is the error programming its rules (nil once they all are)
+	save(ctx context.Context, service *v1.Service, svc *services, syncErr error) error
+	// delete removes the record of the service
+	delete(ctx context.Context, service *v1.Service) error
+	// list returns the records of every service
+	list(ctx context.Context) ([]services, error)
+}
+
 // Services functions - once the service data is taken from teh configMap, these functions will interact with the data
 
-func (s *loxiServices) addService(newSvc services, nodes []*v1.Node, nodePort int32) {
+// addService records the service, its rules are programmed on LoxiLB by syncLoxiRules before it is saved
+func (s *loxiServices) addService(newSvc services) {
 	s.Services = append(s.Services, newSvc)
+}
 
-	// TODO: Add Call of LOXI-LB API for whole worker nodes which is labeled with LB SDK to configurea Load Balancing
-	// LB supported Nodes are marked with LABEL:" netlox.io/app:loadbalancer"
-	// We can extract label with : nodes[0].ObjectMeta.Labels
-	/*
-		vip := newSvc.Vip
-		port := newSvc.Port
-		rips := []
-		nodePort := newSvc.NodePort
-		for node_a in nodes {
-			rips = []
-			for node_b in range nodes {
-				if (node_a !== node_b)
-				_addr := node_b.Status.Addresses[0].Address
-				_port := nodePort
-				rips.append({_addr, _port}, rips)
+// upgradeLegacyServices converts the single port mapping recorded by earlier releases to the list of
+// port mappings (and tags the recorded rules with that port and the service VIP)
+func (s *loxiServices) upgradeLegacyServices() {
+	for x := range s.Services {
+		svc := &s.Services[x]
+		if len(svc.Ports) == 0 && svc.Port != 0 {
+			svc.Ports = []portMapping{
+				{
+					Port:     svc.Port,
+					NodePort: svc.NodePort,
+					Protocol: svc.Type,
+				},
+			}
+			for y := range svc.Rules {
+				if svc.Rules[y].Port == 0 {
+					svc.Rules[y].Port = svc.Port
+					svc.Rules[y].Protocol = svc.Type
+				}
 			}
-			loxiLBCreate(node_a, vip, port, rips)
 		}
+		svc.Port, svc.NodePort, svc.Type = 0, 0, ""
 
-	*/
+		// Services recorded before dual-stack only have the one VIP, which their rules are for
+		if len(svc.Vips) == 0 && svc.Vip != "" {
+			svc.Vips = []string{svc.Vip}
+		}
+		for y := range svc.Rules {
+			if svc.Rules[y].Vip == "" {
+				svc.Rules[y].Vip = svc.Vip
+			}
+		}
+	}
 }
 
 func (s *loxiServices) findService(UID string) *services {
@@ -44,6 +77,8 @@ func (s *loxiServices) findService(UID string) *services {
 	return nil
 }
 
+// delServiceFromUID returns the services without the one of the UID, its rules are removed from LoxiLB by
+// deleteLoxiRules before it is deleted
 func (s *loxiServices) delServiceFromUID(UID string) *loxiServices {
 	// New Services list
 	updatedServices := &loxiServices{}
@@ -52,34 +87,11 @@ func (s *loxiServices) delServiceFromUID(UID string) *loxiServices {
 		if s.Services[x].UID != UID {
 			updatedServices.Services = append(updatedServices.Services, s.Services[x])
 		}
-		// TODO : Add Call of LOXI-LB API to delete Load Balancing
-		// FIXME : deleteService Case, can't get node list....
-		/*
-			vip := newSvc.Vip
-			port := newSvc.Port
-			for node_a in nodes {
-				loxiLBDelete(node_a, vip, port)
-			}
-		*/
 	}
 	// Return the updated service list (without the mentioned service)
 	return updatedServices
 }
 
-func (s *loxiServices) updateServices(vip, name, uid string) string {
-	newsvc := services{
-		Vip:         vip,
-		UID:         uid,
-		ServiceName: name,
-	}
-	s.Services = append(s.Services, newsvc)
-	b, _ := json.Marshal(s)
-
-	// TODO : Add Call of LOXI-LB API to update Load Balancing
-
-	return string(b)
-}
-
 // ConfigMap functions - these wrap all interactions with the kubernetes configmaps
 
 func (lb *loadbalancers) GetServices(cm *v1.ConfigMap) (svcs *loxiServices, err error) {
@@ -87,6 +99,9 @@ func (lb *loadbalancers) GetServices(cm *v1.ConfigMap) (svcs *loxiServices, err
 	b := cm.Data[NetloxServicesKey]
 	// Unmarshall raw data into struct
 	err = json.Unmarshal([]byte(b), &svcs)
+	if err == nil && svcs != nil {
+		svcs.upgradeLegacyServices()
+	}
 	return
 }
 
@@ -127,3 +142,131 @@ func (lb *loadbalancers) UpdateConfigMap(ctx context.Context, cm *v1.ConfigMap,
 	// Return results of configMap create
 	return lb.kubeClient.CoreV1().ConfigMaps(cm.Namespace).Update(ctx, cm, metav1.UpdateOptions{})
 }
+
+// configMapStore records the services of a namespace in the NetloxServicesKey of its netlox configMap
+type configMapStore struct {
+	lb *loadbalancers
+}
+
+var _ serviceStore = &configMapStore{}
+
+// configMapRetry is the backoff re-applying a change to a configMap that was updated by another writer
+var configMapRetry = wait.Backoff{
+	Steps:    10,
+	Duration: 10 * time.Millisecond,
+	Factor:   1.5,
+	Jitter:   0.5,
+}
+
+// load returns the netlox configMap of the namespace (nil if it doesn't exist) and the services recorded
+// in it, services that can't be read are logged and treated as empty
+func (s *configMapStore) load(ctx context.Context, namespace string) (*v1.ConfigMap, *loxiServices, error) {
+	cm, err := s.lb.GetConfigMap(ctx, NetloxClientConfig, namespace)
+	if apierrors.IsNotFound(err) {
+		return nil, &loxiServices{}, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to retrieve configMap [%s] in [%s] : %v", s.lb.cloudConfigMap, namespace, err)
+	}
+	if _, ok := cm.Data[NetloxServicesKey]; !ok {
+		return cm, &loxiServices{}, nil
+	}
+	svcs, err := s.lb.GetServices(cm)
+	if err != nil {
+		// The services are never treated as empty, the next update would overwrite the records of every
+		// other service of the namespace
+		return nil, nil, fmt.Errorf("Unable to retrieve services from configMap [%s] in [%s] : %v", s.lb.cloudConfigMap, namespace, err)
+	}
+	if svcs == nil {
+		svcs = &loxiServices{}
+	}
+	return cm, svcs, nil
+}
+
+func (s *configMapStore) get(ctx context.Context, service *v1.Service) (*services, error) {
+	_, svcs, err := s.load(ctx, service.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	return svcs.findService(string(service.UID)), nil
+}
+
+func (s *configMapStore) save(ctx context.Context, service *v1.Service, svc *services, syncErr error) error {
+	return s.update(ctx, service.Namespace, func(svcs *loxiServices) (*loxiServices, bool) {
+		existing := svcs.findService(svc.UID)
+		if existing == nil {
+			svcs.addService(*svc)
+			return svcs, true
+		}
+		if reflect.DeepEqual(existing, svc) {
+			return nil, false
+		}
+		*existing = *svc
+		return svcs, true
+	})
+}
+
+func (s *configMapStore) delete(ctx context.Context, service *v1.Service) error {
+	return s.update(ctx, service.Namespace, func(svcs *loxiServices) (*loxiServices, bool) {
+		if svcs.findService(string(service.UID)) == nil {
+			return nil, false
+		}
+		return svcs.delServiceFromUID(string(service.UID)), true
+	})
+}
+
+// update applies the change of a single service to the services recorded in the netlox configMap of the
+// namespace, creating the configMap if needed. change returns the services to record, or false if there is
+// nothing to update. When another writer (e.g. another service of the namespace syncing at the same time)
+// updated the configMap first, it is re-read and the change re-applied, so neither update is lost.
+func (s *configMapStore) update(ctx context.Context, namespace string, change func(*loxiServices) (*loxiServices, bool)) error {
+	return retry.OnError(configMapRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		cm, svcs, err := s.load(ctx, namespace)
+		if err != nil {
+			return err
+		}
+		svcs, ok := change(svcs)
+		if !ok {
+			return nil
+		}
+		if cm == nil {
+			cm, err = s.lb.CreateConfigMap(ctx, NetloxClientConfig, namespace)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = s.lb.UpdateConfigMap(ctx, cm, svcs)
+		return err
+	})
+}
+
+func (s *configMapStore) list(ctx context.Context) ([]services, error) {
+	cms, err := s.lb.kubeClient.CoreV1().ConfigMaps(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("metadata.name=%s", s.lb.cloudConfigMap),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list [%s] configMaps : %v", s.lb.cloudConfigMap, err)
+	}
+	var all []services
+	for x := range cms.Items {
+		cm := &cms.Items[x]
+		if cm.Name != s.lb.cloudConfigMap {
+			continue
+		}
+		if _, ok := cm.Data[NetloxServicesKey]; !ok {
+			continue
+		}
+		svc, err := s.lb.GetServices(cm)
+		if err != nil {
+			klog.Errorf("Unable to retrieve services from configMap [%s] in [%s], [%s]", cm.Name, cm.Namespace, err.Error())
+			continue
+		}
+		for y := range svc.Services {
+			svc.Services[y].Namespace = cm.Namespace
+			all = append(all, svc.Services[y])
+		}
+	}
+	return all, nil
+}
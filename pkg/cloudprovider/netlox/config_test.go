@@ -0,0 +1,209 @@
+package netlox
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestGetServices_legacyPortMapping(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: NetloxClientConfig, Namespace: "default"},
+		Data: map[string]string{
+			NetloxServicesKey: `{"services":[{"vip":"192.168.0.201","port":80,"type":"TCP","uid":"nginx-uid","serviceName":"nginx","nodePort":30080,"rules":[{"loxilb":"10.0.0.1","node":"lb-1"}]}]}`,
+		},
+	}
+	lb := &loadbalancers{}
+	svcs, err := lb.GetServices(cm)
+	if err != nil {
+		t.Fatalf("GetServices() error = %v", err)
+	}
+
+	want := services{
+		Vip:         "192.168.0.201",
+		Vips:        []string{"192.168.0.201"},
+		UID:         "nginx-uid",
+		ServiceName: "nginx",
+		Ports:       []portMapping{{Port: 80, NodePort: 30080, Protocol: "TCP"}},
+		Rules:       []loxiRule{{LoxiLB: "10.0.0.1", Node: "lb-1", Vip: "192.168.0.201", Port: 80, Protocol: "TCP"}},
+	}
+	if got := svcs.findService("nginx-uid"); got == nil || !reflect.DeepEqual(*got, want) {
+		t.Errorf("GetServices() = %+v, want %+v", got, want)
+	}
+}
+
+// enforceResourceVersion makes the fake clientset reject a configMap update whose resourceVersion isn't the
+// latest with a conflict, as the API server does
+func enforceResourceVersion(client *fake.Clientset) {
+	client.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		update := action.(k8stesting.UpdateAction).GetObject().(*v1.ConfigMap)
+		obj, err := client.Tracker().Get(action.GetResource(), update.Namespace, update.Name)
+		if err != nil {
+			return true, nil, err
+		}
+		current := obj.(*v1.ConfigMap)
+		if current.ResourceVersion != update.ResourceVersion {
+			return true, nil, apierrors.NewConflict(action.GetResource().GroupResource(), update.Name, fmt.Errorf("the object has been modified"))
+		}
+		version, _ := strconv.Atoi(current.ResourceVersion)
+		update = update.DeepCopy()
+		update.ResourceVersion = strconv.Itoa(version + 1)
+		return true, update, client.Tracker().Update(action.GetResource(), update, update.Namespace)
+	})
+}
+
+// slowConfigMapUpdates delays every configMap update, so that concurrent writers read the configMap
+// before each other's updates
+type slowConfigMapUpdates struct {
+	*fake.Clientset
+}
+
+func (c slowConfigMapUpdates) CoreV1() typedcorev1.CoreV1Interface {
+	return slowCoreV1{c.Clientset.CoreV1()}
+}
+
+type slowCoreV1 struct {
+	typedcorev1.CoreV1Interface
+}
+
+func (c slowCoreV1) ConfigMaps(namespace string) typedcorev1.ConfigMapInterface {
+	return slowConfigMaps{c.CoreV1Interface.ConfigMaps(namespace)}
+}
+
+type slowConfigMaps struct {
+	typedcorev1.ConfigMapInterface
+}
+
+func (c slowConfigMaps) Update(ctx context.Context, cm *v1.ConfigMap, opts metav1.UpdateOptions) (*v1.ConfigMap, error) {
+	time.Sleep(5 * time.Millisecond)
+	return c.ConfigMapInterface.Update(ctx, cm, opts)
+}
+
+func TestConfigMapStore_reappliesConflictingChange(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: NetloxClientConfig, Namespace: "default", ResourceVersion: "1"},
+		Data: map[string]string{
+			NetloxServicesKey: `{"services":[{"vip":"192.168.0.10","uid":"first-uid","serviceName":"first"}]}`,
+		},
+	}
+	lb, kubeClient := newTestLoadBalancers(f, cm)
+	enforceResourceVersion(kubeClient)
+
+	// Another writer records its service between our read and update
+	var raced bool
+	kubeClient.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if raced {
+			return false, nil, nil
+		}
+		raced = true
+		other := cm.DeepCopy()
+		other.ResourceVersion = "2"
+		other.Data[NetloxServicesKey] = `{"services":[{"vip":"192.168.0.10","uid":"first-uid","serviceName":"first"},{"vip":"192.168.0.11","uid":"second-uid","serviceName":"second"}]}`
+		return false, nil, kubeClient.Tracker().Update(action.GetResource(), other, other.Namespace)
+	})
+
+	third := testService("third")
+	err := lb.store.save(context.Background(), third, &services{Vip: "192.168.0.12", UID: string(third.UID), ServiceName: third.Name}, nil)
+	if err != nil {
+		t.Fatalf("save() error = %v", err)
+	}
+	if !raced {
+		t.Fatalf("the concurrent writer didn't run")
+	}
+	for _, name := range []string{"first", "second", "third"} {
+		if entry := findTestService(t, lb, testService(name)); entry == nil {
+			t.Errorf("service [%s] is no longer recorded", name)
+		}
+	}
+}
+
+func TestConfigMapStore_unreadableServices(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	const unreadable = `{"services":[{"vip":"192.168.0.10","uid":"first-uid"`
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: NetloxClientConfig, Namespace: "default"},
+		Data:       map[string]string{NetloxServicesKey: unreadable},
+	}
+	lb, kubeClient := newTestLoadBalancers(f, cm)
+
+	// The records of the other services can't be read, so nothing is overwritten
+	second := testService("second")
+	if _, err := lb.store.get(context.Background(), second); err == nil {
+		t.Errorf("get() expected an error for the unreadable services")
+	}
+	if err := lb.store.save(context.Background(), second, &services{Vip: "192.168.0.11", UID: string(second.UID), ServiceName: second.Name}, nil); err == nil {
+		t.Errorf("save() expected an error for the unreadable services")
+	}
+	got, err := kubeClient.CoreV1().ConfigMaps("default").Get(context.Background(), NetloxClientConfig, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Data[NetloxServicesKey] != unreadable {
+		t.Errorf("services = %s, want the unreadable services kept", got.Data[NetloxServicesKey])
+	}
+}
+
+func TestEnsureLoadBalancer_concurrentServices(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	var svcs []*v1.Service
+	var objects []runtime.Object
+	for i := 0; i < 10; i++ {
+		svc := testService(fmt.Sprintf("web-%d", i), v1.ServicePort{Port: 80, NodePort: int32(30080 + i), Protocol: v1.ProtocolTCP})
+		svcs = append(svcs, svc)
+		objects = append(objects, svc)
+	}
+	lb, kubeClient := newTestLoadBalancers(f, objects...)
+	enforceResourceVersion(kubeClient)
+	lb.kubeClient = slowConfigMapUpdates{kubeClient}
+
+	// Every service syncs at once, reading the configMap before the others have updated it
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make([]error, len(svcs))
+	for i := range svcs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			_, errs[i] = lb.EnsureLoadBalancer(context.Background(), "kubernetes", svcs[i].DeepCopy(), nil)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	vips := map[string]bool{}
+	for i, svc := range svcs {
+		if errs[i] != nil {
+			t.Errorf("EnsureLoadBalancer(%s) error = %v", svc.Name, errs[i])
+			continue
+		}
+		entry := findTestService(t, lb, svc)
+		if entry == nil {
+			t.Errorf("service [%s] isn't recorded", svc.Name)
+			continue
+		}
+		if vips[entry.Vip] {
+			t.Errorf("vip %s is recorded for more than one service", entry.Vip)
+		}
+		vips[entry.Vip] = true
+	}
+}
@@ -0,0 +1,232 @@
+package netlox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"netlox.io/netlox/pkg/loxilb"
+)
+
+// fakeLoxiLB stands in for the LoxiLB API of every load balancer node. All requests are served by one
+// server and the rules are recorded against the node address the request was sent to.
+type fakeLoxiLB struct {
+	mu    sync.Mutex
+	rules map[string]map[string]loxilb.LoadBalancer
+	// routes are the gateways of the routes per node address and destination
+	routes map[string]map[string]string
+	fail   map[string]bool
+	// rejectExisting makes creating a rule that already exists fail, instead of updating it
+	rejectExisting bool
+	// writes counts the create/delete requests received per node address
+	writes map[string]int
+	srv    *httptest.Server
+}
+
+func newFakeLoxiLB() *fakeLoxiLB {
+	f := &fakeLoxiLB{
+		rules:  map[string]map[string]loxilb.LoadBalancer{},
+		routes: map[string]map[string]string{},
+		fail:   map[string]bool{},
+		writes: map[string]int{},
+	}
+	f.srv = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+func (f *fakeLoxiLB) Close() {
+	f.srv.Close()
+}
+
+// client returns a netloxClient that sends the requests for every node address to the fake
+func (f *fakeLoxiLB) client() *netloxClient {
+	srvAddr := f.srv.Listener.Addr().String()
+	dialer := &net.Dialer{}
+	return &netloxClient{
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, srvAddr)
+				},
+			},
+		},
+		port: loxilb.DefaultPort,
+	}
+}
+
+// setRejectExisting makes creating a rule that already exists fail (as older LoxiLB releases do), rather
+// than updating its endpoints
+func (f *fakeLoxiLB) setRejectExisting(reject bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rejectExisting = reject
+}
+
+// setFailing makes every request sent to the node address fail
+func (f *fakeLoxiLB) setFailing(address string, fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail[address] = fail
+}
+
+// ruleKey identifies a rule the same way LoxiLB does
+func ruleKey(externalIP string, port int32, protocol string) string {
+	return fmt.Sprintf("%s:%d/%s", externalIP, port, strings.ToLower(protocol))
+}
+
+// get returns the rule programmed on the node address
+func (f *fakeLoxiLB) get(address, externalIP string, port int32, protocol string) (loxilb.LoadBalancer, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	rule, ok := f.rules[address][ruleKey(externalIP, port, protocol)]
+	return rule, ok
+}
+
+// count returns the number of rules programmed on the node address
+func (f *fakeLoxiLB) count(address string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.rules[address])
+}
+
+// writeCount returns the number of create/delete requests received by the node address
+func (f *fakeLoxiLB) writeCount(address string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writes[address]
+}
+
+// endpoints returns the sorted "ip:port" endpoints of a rule programmed on the node address
+func (f *fakeLoxiLB) endpoints(address, externalIP string, port int32, protocol string) []string {
+	rule, ok := f.get(address, externalIP, port, protocol)
+	if !ok {
+		return nil
+	}
+	var eps []string
+	for _, ep := range rule.Endpoints {
+		eps = append(eps, net.JoinHostPort(ep.EndpointIP, strconv.Itoa(int(ep.TargetPort))))
+	}
+	sort.Strings(eps)
+	return eps
+}
+
+// routeGateways returns the gateway of every route programmed on the node address by destination
+func (f *fakeLoxiLB) routeGateways(address string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	gateways := map[string]string{}
+	for destination, gateway := range f.routes[address] {
+		gateways[destination] = gateway
+	}
+	return gateways
+}
+
+// setRoute programs a route on the node address, as if made outside the controller
+func (f *fakeLoxiLB) setRoute(address, destination, gateway string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.routes[address] == nil {
+		f.routes[address] = map[string]string{}
+	}
+	f.routes[address][destination] = gateway
+}
+
+func (f *fakeLoxiLB) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	address, _, _ := net.SplitHostPort(r.Host)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.fail[address] {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(loxilb.Error{Code: 500, Message: "fake failure"})
+		return
+	}
+	if f.rules[address] == nil {
+		f.rules[address] = map[string]loxilb.LoadBalancer{}
+	}
+	if f.routes[address] == nil {
+		f.routes[address] = map[string]string{}
+	}
+	if r.Method != http.MethodGet {
+		f.writes[address]++
+	}
+
+	const lbPath = "/netlox/v1/config/loadbalancer"
+	const routePath = "/netlox/v1/config/route"
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == lbPath:
+		rule := loxilb.LoadBalancer{}
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		args := rule.ServiceArguments
+		key := ruleKey(args.ExternalIP, args.Port, args.Protocol)
+		if _, ok := f.rules[address][key]; ok && f.rejectExisting {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(loxilb.Error{Code: 409, Message: "lb rule exists"})
+			return
+		}
+		f.rules[address][key] = rule
+	case r.Method == http.MethodGet && r.URL.Path == lbPath+"/all":
+		list := struct {
+			Attr []loxilb.LoadBalancer `json:"lbAttr"`
+		}{}
+		for _, rule := range f.rules[address] {
+			list.Attr = append(list.Attr, rule)
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, lbPath+"/externalipaddress/"):
+		// .../externalipaddress/{ip}/port/{port}/protocol/{proto}
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, lbPath+"/externalipaddress/"), "/")
+		if len(parts) != 5 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		port, _ := strconv.Atoi(parts[2])
+		key := ruleKey(parts[0], int32(port), parts[4])
+		if _, ok := f.rules[address][key]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.rules[address], key)
+	case r.Method == http.MethodPost && r.URL.Path == routePath:
+		route := loxilb.Route{}
+		if err := json.NewDecoder(r.Body).Decode(&route); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if _, ok := f.routes[address][route.DestinationIPNet]; ok {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(loxilb.Error{Code: 409, Message: "route exists"})
+			return
+		}
+		f.routes[address][route.DestinationIPNet] = route.Gateway
+	case r.Method == http.MethodGet && r.URL.Path == routePath+"/all":
+		list := struct {
+			Attr []loxilb.Route `json:"routeAttr"`
+		}{}
+		for destination, gateway := range f.routes[address] {
+			list.Attr = append(list.Attr, loxilb.Route{DestinationIPNet: destination, Gateway: gateway})
+		}
+		json.NewEncoder(w).Encode(list)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, routePath+"/destinationIPNet/"):
+		// .../destinationIPNet/{ip}/{mask}
+		destination := strings.TrimPrefix(r.URL.Path, routePath+"/destinationIPNet/")
+		if _, ok := f.routes[address][destination]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.routes[address], destination)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -2,7 +2,7 @@ package netlox
 
 import (
 	"context"
-	"net/http"
+	"fmt"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -11,57 +11,76 @@ import (
 )
 
 type instances struct {
-	client *http.Client
+	inventory inventory
+	// power reports which instances are shut down, none are without it
+	power powerSource
 }
 
-func newInstances(c *http.Client) cloudprovider.Instances {
+func newInstances(inv inventory, power powerSource) *instances {
 	return &instances{
-		client: c,
+		inventory: inv,
+		power:     power,
 	}
 }
 
-// NodeAddresses returns the addresses of the specified instance.
-func (i *instances) NodeAddresses(ctx context.Context, name types.NodeName) ([]v1.NodeAddress, error) {
-	klog.V(5).Infof("NodeAddresses(%v)", name)
-
-	var addrs []v1.NodeAddress
+// shutdown returns true if the instance is powered off
+func (i *instances) shutdown(ctx context.Context, inst *instance) (bool, error) {
+	if i.power == nil {
+		return false, nil
+	}
+	return i.power.shutdown(ctx, inst)
+}
 
-	if string(name) == "master-c2-1" {
-		nodeAddr := v1.NodeAddress{
-			Type:    v1.NodeInternalIP,
-			Address: "192.168.10.101",
-		}
-		nodeExternalAddr := v1.NodeAddress{
-			Type:    v1.NodeExternalIP,
-			Address: "192.168.10.101",
-		}
-		nodeHostName := v1.NodeAddress{
-			Type:    v1.NodeHostName,
-			Address: "node1",
-		}
-		addrs = append(addrs, nodeAddr)
-		addrs = append(addrs, nodeExternalAddr)
-		addrs = append(addrs, nodeHostName)
-	} else if string(name) == "node-c2-1" {
-		nodeAddr := v1.NodeAddress{
-			Type:    v1.NodeInternalIP,
-			Address: "192.168.10.102",
-		}
-		nodeExternalAddr := v1.NodeAddress{
-			Type:    v1.NodeExternalIP,
-			Address: "192.168.10.102",
+// instanceByName returns the instance of the node, cloudprovider.InstanceNotFound if it isn't in the inventory
+func (i *instances) instanceByName(ctx context.Context, name types.NodeName) (*instance, error) {
+	all, err := i.inventory.instances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for x := range all {
+		if all[x].Name == string(name) {
+			return &all[x], nil
 		}
-		nodeHostName := v1.NodeAddress{
-			Type:    v1.NodeHostName,
-			Address: "node2",
+	}
+	return nil, cloudprovider.InstanceNotFound
+}
+
+// instanceByProviderID returns the instance with the provider ID, cloudprovider.InstanceNotFound if it isn't
+// in the inventory
+func (i *instances) instanceByProviderID(ctx context.Context, providerID string) (*instance, error) {
+	id, err := parseProviderID(providerID)
+	if err != nil {
+		return nil, err
+	}
+	all, err := i.inventory.instances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for x := range all {
+		if all[x].ID == id {
+			return &all[x], nil
 		}
+	}
+	return nil, cloudprovider.InstanceNotFound
+}
 
-		addrs = append(addrs, nodeAddr)
-		addrs = append(addrs, nodeExternalAddr)
-		addrs = append(addrs, nodeHostName)
+// instanceOfNode returns the instance of the node, found by its provider ID once it has one or else by its
+// name. cloudprovider.InstanceNotFound is returned if the node isn't in the inventory.
+func (i *instances) instanceOfNode(ctx context.Context, node *v1.Node) (*instance, error) {
+	if node.Spec.ProviderID != "" {
+		return i.instanceByProviderID(ctx, node.Spec.ProviderID)
 	}
+	return i.instanceByName(ctx, types.NodeName(node.Name))
+}
 
-	return addrs, nil
+// NodeAddresses returns the addresses of the specified instance.
+func (i *instances) NodeAddresses(ctx context.Context, name types.NodeName) ([]v1.NodeAddress, error) {
+	klog.V(5).Infof("NodeAddresses(%v)", name)
+	inst, err := i.instanceByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return inst.Addresses, nil
 }
 
 // NodeAddressesByProviderID returns the addresses of the specified instance.
@@ -71,101 +90,56 @@ func (i *instances) NodeAddresses(ctx context.Context, name types.NodeName) ([]v
 // services cannot be used in this method to obtain nodeaddresses
 func (i *instances) NodeAddressesByProviderID(ctx context.Context, providerID string) ([]v1.NodeAddress, error) {
 	klog.V(5).Infof("NodeAddressesByProviderID(%v)", providerID)
-
-	// TODO: Add split function to get the instance ID from provider ID and do a "lookup"
-
-	var addrs []v1.NodeAddress
-
-	// FIXME: Return static IP accoring to HOST IP
-	if providerID == "netlox://m-c2-1" {
-		nodeAddr := v1.NodeAddress{
-			Type:    v1.NodeInternalIP,
-			Address: "192.168.10.101",
-		}
-		nodeExternalAddr := v1.NodeAddress{
-			Type:    v1.NodeExternalIP,
-			Address: "192.168.10.101",
-		}
-		nodeHostName := v1.NodeAddress{
-			Type:    v1.NodeHostName,
-			Address: "node1",
-		}
-
-		addrs = append(addrs, nodeAddr)
-		addrs = append(addrs, nodeExternalAddr)
-		addrs = append(addrs, nodeHostName)
-	} else if providerID == "netlox://n-c2-1" {
-		nodeAddr := v1.NodeAddress{
-			Type:    v1.NodeInternalIP,
-			Address: "192.168.10.102",
-		}
-		nodeExternalAddr := v1.NodeAddress{
-			Type:    v1.NodeExternalIP,
-			Address: "192.168.10.102",
-		}
-		nodeHostName := v1.NodeAddress{
-			Type:    v1.NodeHostName,
-			Address: "node2",
-		}
-		addrs = append(addrs, nodeAddr)
-		addrs = append(addrs, nodeExternalAddr)
-		addrs = append(addrs, nodeHostName)
+	inst, err := i.instanceByProviderID(ctx, providerID)
+	if err != nil {
+		return nil, err
 	}
-
-	return addrs, nil
+	return inst.Addresses, nil
 }
 
 // InstanceID returns the cloud provider ID of the node with the specified NodeName.
 // Note that if the instance does not exist, we must return ("", cloudprovider.InstanceNotFound)
 // cloudprovider.InstanceNotFound should NOT be returned for instances that exist but are stopped/sleeping
+// The node lifecycle controller deletes a node without a provider ID that InstanceID doesn't find, so a
+// node that isn't in the inventory is an error rather than InstanceNotFound: only the nodes initialized from
+// the inventory (whose netlox:// provider ID is then removed from it) are reported gone.
 func (i *instances) InstanceID(ctx context.Context, nodeName types.NodeName) (string, error) {
 	klog.V(5).Infof("InstanceID(%v)", nodeName)
-
-	var instanceID string
-
-	if string(nodeName) == "master-c2-1" {
-		instanceID = "netlox://m-c2-1"
-	} else if string(nodeName) == "node-c2-1" {
-		instanceID = "netlox://n-c2-1"
+	inst, err := i.instanceByName(ctx, nodeName)
+	if err == cloudprovider.InstanceNotFound {
+		return "", fmt.Errorf("Node [%s] isn't in the inventory", nodeName)
 	}
-
-	return instanceID, nil
+	if err != nil {
+		return "", err
+	}
+	// The cloud node controller prefixes the ID with netlox:// to make the provider ID
+	return inst.ID, nil
 }
 
 // InstanceType returns the type of the specified instance.
 func (i *instances) InstanceType(ctx context.Context, name types.NodeName) (string, error) {
 	klog.V(5).Infof("InstanceType(%v)", name)
-
-	var instanceType string
-
-	if string(name) == "master-c2-1" {
-		instanceType = "vbox.vm.512mb.1cpu"
-	} else if string(name) == "node-c2-1" {
-		instanceType = "vbox.vm.1g.2cpu"
+	inst, err := i.instanceByName(ctx, name)
+	if err != nil {
+		return "", err
 	}
-
-	return instanceType, nil
+	return inst.Type, nil
 }
 
 // InstanceTypeByProviderID returns the type of the specified instance.
 func (i *instances) InstanceTypeByProviderID(ctx context.Context, providerID string) (string, error) {
 	klog.V(5).Infof("InstanceTypeByProviderID(%v)", providerID)
-
-	var instanceType string
-
-	if providerID == "netlox://m-c2-1" {
-		instanceType = "vbox.vm.512mb.1cpu"
-	} else if providerID == "netlox://n-c2-1" {
-		instanceType = "vbox.vm.1g.2cpu"
+	inst, err := i.instanceByProviderID(ctx, providerID)
+	if err != nil {
+		return "", err
 	}
-
-	return instanceType, nil
+	return inst.Type, nil
 }
 
 // AddSSHKeyToAllInstances adds an SSH public key as a legal identity for all instances
 // expected format for the key is standard ssh-keygen format: <protocol> <blob>
 func (i *instances) AddSSHKeyToAllInstances(ctx context.Context, user string, keyData []byte) error {
-	klog.V(5).Info("AddSSHKeyToAllInstances(%v, %v)", user, keyData)
+	klog.V(5).Infof("AddSSHKeyToAllInstances(%v, %v)", user, keyData)
 	return cloudprovider.NotImplemented
 }
 
@@ -173,16 +147,7 @@ func (i *instances) AddSSHKeyToAllInstances(ctx context.Context, user string, ke
 // On most clouds (e.g. GCE) this is the hostname, so we provide the hostname
 func (i *instances) CurrentNodeName(ctx context.Context, hostname string) (types.NodeName, error) {
 	klog.V(5).Infof("CurrentNodeName(%v)", hostname)
-
-	var nodeName types.NodeName
-
-	if hostname == "master-c2-1" {
-		nodeName = "node1"
-	} else if hostname == "node-c2-1" {
-		nodeName = "node2"
-	}
-
-	return nodeName, nil
+	return types.NodeName(hostname), nil
 }
 
 // InstanceExistsByProviderID returns true if the instance for the given provider exists.
@@ -190,29 +155,22 @@ func (i *instances) CurrentNodeName(ctx context.Context, hostname string) (types
 // This method should still return true for instances that exist but are stopped/sleeping.
 func (i *instances) InstanceExistsByProviderID(ctx context.Context, providerID string) (bool, error) {
 	klog.V(5).Infof("InstanceExistsByProviderID(%v)", providerID)
-
-	var exists bool
-
-	if providerID == "netlox://m-c2-1" {
-		exists = true
-	} else if providerID == "netlox://n-c2-1" {
-		exists = true
+	_, err := i.instanceByProviderID(ctx, providerID)
+	if err == cloudprovider.InstanceNotFound {
+		return false, nil
 	}
-
-	return exists, nil
+	if err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // InstanceShutdownByProviderID returns true if the instance is shutdown in cloudprovider
 func (i *instances) InstanceShutdownByProviderID(ctx context.Context, providerID string) (bool, error) {
 	klog.V(5).Infof("InstanceShutdownByProviderID(%v)", providerID)
-
-	var shutdown bool
-
-	if providerID == "netlox://m-c2-1" {
-		shutdown = false
-	} else if providerID == "netlox://n-c2-1" {
-		shutdown = true
+	inst, err := i.instanceByProviderID(ctx, providerID)
+	if err != nil {
+		return false, err
 	}
-
-	return shutdown, nil
+	return i.shutdown(ctx, inst)
 }
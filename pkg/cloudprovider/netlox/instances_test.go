@@ -0,0 +1,192 @@
+package netlox
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	cloudprovider "k8s.io/cloud-provider"
+)
+
+const testInventory = `
+instances:
+  - name: master-1
+    id: m-1
+    type: baremetal.large
+    zone: rack-1
+    region: dc-1
+    addresses:
+      - type: InternalIP
+        address: 10.0.0.1
+      - type: Hostname
+        address: master-1
+  - name: worker-1
+    id: w-1
+    type: baremetal.small
+    addresses:
+      - type: InternalIP
+        address: 10.0.0.2
+`
+
+func TestInstances(t *testing.T) {
+	file, err := ioutil.TempFile("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(testInventory); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	kubeClient := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: NetloxInventoryConfig, Namespace: "kube-system"},
+		Data:       map[string]string{NetloxInventoryKey: testInventory},
+	})
+
+	for name, inv := range map[string]inventory{
+		"configMap": &configMapInventory{kubeClient: kubeClient, namespace: "kube-system", name: NetloxInventoryConfig},
+		"file":      &fileInventory{path: file.Name()},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			i := newInstances(inv, nil)
+
+			addresses, err := i.NodeAddresses(ctx, "master-1")
+			want := []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.1"}, {Type: v1.NodeHostName, Address: "master-1"}}
+			if err != nil || !reflect.DeepEqual(addresses, want) {
+				t.Errorf("NodeAddresses() = %v, %v, want %v", addresses, err, want)
+			}
+			addresses, err = i.NodeAddressesByProviderID(ctx, "netlox://w-1")
+			want = []v1.NodeAddress{{Type: v1.NodeInternalIP, Address: "10.0.0.2"}}
+			if err != nil || !reflect.DeepEqual(addresses, want) {
+				t.Errorf("NodeAddressesByProviderID() = %v, %v, want %v", addresses, err, want)
+			}
+			if id, err := i.InstanceID(ctx, "worker-1"); err != nil || id != "w-1" {
+				t.Errorf("InstanceID() = %q, %v, want w-1", id, err)
+			}
+			if instanceType, err := i.InstanceType(ctx, "master-1"); err != nil || instanceType != "baremetal.large" {
+				t.Errorf("InstanceType() = %q, %v, want baremetal.large", instanceType, err)
+			}
+			if instanceType, err := i.InstanceTypeByProviderID(ctx, "netlox://w-1"); err != nil || instanceType != "baremetal.small" {
+				t.Errorf("InstanceTypeByProviderID() = %q, %v, want baremetal.small", instanceType, err)
+			}
+			if exists, err := i.InstanceExistsByProviderID(ctx, "netlox://w-1"); err != nil || !exists {
+				t.Errorf("InstanceExistsByProviderID() = %v, %v, want true", exists, err)
+			}
+
+			// Unknown nodes
+			if _, err := i.NodeAddresses(ctx, "worker-2"); err != cloudprovider.InstanceNotFound {
+				t.Errorf("NodeAddresses() error = %v, want InstanceNotFound", err)
+			}
+			if _, err := i.InstanceID(ctx, "worker-2"); err == nil || err == cloudprovider.InstanceNotFound {
+				t.Errorf("InstanceID() error = %v, want an error other than InstanceNotFound", err)
+			}
+			if exists, err := i.InstanceExistsByProviderID(ctx, "netlox://w-2"); err != nil || exists {
+				t.Errorf("InstanceExistsByProviderID() = %v, %v, want false", exists, err)
+			}
+		})
+	}
+}
+
+func TestInstances_missingConfigMap(t *testing.T) {
+	i := newInstances(&configMapInventory{kubeClient: fake.NewSimpleClientset(), namespace: "kube-system", name: NetloxInventoryConfig}, nil)
+
+	// Without its configMap no instance is known, which mustn't be reported as the instance being gone
+	exists, err := i.InstanceExistsByProviderID(context.Background(), "netlox://m-1")
+	if err == nil || err == cloudprovider.InstanceNotFound || exists {
+		t.Errorf("InstanceExistsByProviderID() = %v, %v, want an error", exists, err)
+	}
+	if _, err := i.NodeAddresses(context.Background(), "master-1"); err == nil || err == cloudprovider.InstanceNotFound {
+		t.Errorf("NodeAddresses() error = %v, want an error", err)
+	}
+}
+
+func TestInstances_unlistedNode(t *testing.T) {
+	i := newInstances(staticInventory{{Name: "master-1", ID: "m-1"}}, nil)
+	ctx := context.Background()
+
+	// As the node lifecycle controller does for a NotReady node: a node that joined without being listed has
+	// no provider ID and mustn't be reported gone (and deleted), while a node initialized from the inventory
+	// that was removed from it is
+	if _, err := i.InstanceID(ctx, "worker-1"); err == nil || err == cloudprovider.InstanceNotFound {
+		t.Errorf("InstanceID() of an unlisted node error = %v, want an error other than InstanceNotFound", err)
+	}
+	if exists, err := i.InstanceExistsByProviderID(ctx, "netlox://w-1"); err != nil || exists {
+		t.Errorf("InstanceExistsByProviderID() of a removed node = %v, %v, want false", exists, err)
+	}
+}
+
+func TestParseInventory_invalid(t *testing.T) {
+	for name, data := range map[string]string{
+		"no id":   "instances:\n  - name: worker-1\n",
+		"no name": "instances:\n  - id: w-1\n",
+		"yaml":    "instances: [",
+	} {
+		if _, err := parseInventory([]byte(data)); err == nil {
+			t.Errorf("parseInventory(%s) expected an error", name)
+		}
+	}
+}
+
+func TestParseProviderID(t *testing.T) {
+	tests := []struct {
+		providerID string
+		want       string
+		wantErr    bool
+	}{
+		{providerID: "netlox://w-1", want: "w-1"},
+		{providerID: "netlox:///w-1", want: "w-1"},
+		{providerID: "netlox://", wantErr: true},
+		{providerID: "netlox://rack/w-1", wantErr: true},
+		{providerID: "aws:///eu-west-1a/i-1234", wantErr: true},
+		{providerID: "w-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseProviderID(tt.providerID)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseProviderID(%q) = %q, %v, want %q (error %v)", tt.providerID, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestInstanceOfNode(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: NetloxInventoryConfig, Namespace: "kube-system"},
+		Data:       map[string]string{NetloxInventoryKey: testInventory},
+	})
+	i := newInstances(&configMapInventory{kubeClient: kubeClient, namespace: "kube-system", name: NetloxInventoryConfig}, nil)
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		node    *v1.Node
+		want    string
+		wantErr bool
+	}{
+		// A node is found by its name until it has a provider ID
+		{name: "by name", node: &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "master-1"}}, want: "m-1"},
+		{name: "by provider ID", node: &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "renamed"}, Spec: v1.NodeSpec{ProviderID: "netlox://w-1"}}, want: "w-1"},
+		{name: "unknown provider ID", node: &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker-1"}, Spec: v1.NodeSpec{ProviderID: "netlox://w-2"}}, wantErr: true},
+		{name: "other provider", node: &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker-1"}, Spec: v1.NodeSpec{ProviderID: "other://w-1"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inst, err := i.instanceOfNode(ctx, tt.node)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("instanceOfNode() = %+v, expected an error", inst)
+				}
+				return
+			}
+			if err != nil || inst.ID != tt.want {
+				t.Errorf("instanceOfNode() = %+v, %v, want %s", inst, err, tt.want)
+			}
+		})
+	}
+}
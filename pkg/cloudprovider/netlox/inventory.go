@@ -0,0 +1,194 @@
+package netlox
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// NetloxInventoryConfig is the name of the node inventory config Map in the manifests
+	NetloxInventoryConfig = "netlox-inventory"
+
+	// NetloxInventoryKey is the key in the inventory ConfigMap (and the top level key of an inventory file)
+	// that lists the instances
+	NetloxInventoryKey = "instances"
+)
+
+// instance is the inventory record of the machine running a node
+type instance struct {
+	// Name is the name of the node
+	Name string `json:"name"`
+	// ID identifies the machine, the provider ID of the node is netlox://<id>
+	ID        string           `json:"id"`
+	Type      string           `json:"type,omitempty"`
+	Addresses []v1.NodeAddress `json:"addresses,omitempty"`
+	// Zone and Region are the failure domain of the instance
+	Zone   string `json:"zone,omitempty"`
+	Region string `json:"region,omitempty"`
+	// BMC is the URL the power state of the instance is read from, e.g. its Redfish ComputerSystem
+	BMC string `json:"bmc,omitempty"`
+}
+
+// zoneRange maps the nodes with an address in CIDR to a failure domain
+type zoneRange struct {
+	CIDR   string `json:"cidr"`
+	Zone   string `json:"zone"`
+	Region string `json:"region,omitempty"`
+}
+
+// providerID returns the provider ID of the node running on the instance
+func (i *instance) providerID() string {
+	return fmt.Sprintf("%s://%s", ProviderName, i.ID)
+}
+
+// parseProviderID returns the instance ID of a netlox://<id> provider ID, the ID may also be given as an
+// absolute path (netlox:///<id>) as some tools write it
+func parseProviderID(providerID string) (string, error) {
+	prefix := ProviderName + "://"
+	if !strings.HasPrefix(providerID, prefix) {
+		return "", fmt.Errorf("Provider ID [%s] isn't a %s<id> provider ID", providerID, prefix)
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(providerID, prefix), "/")
+	if id == "" || strings.Contains(id, "/") {
+		return "", fmt.Errorf("Provider ID [%s] doesn't have a valid instance ID", providerID)
+	}
+	return id, nil
+}
+
+// inventory is the source of the instances of the cluster
+type inventory interface {
+	// instances returns every instance
+	instances(ctx context.Context) ([]instance, error)
+	// zones returns the CIDR-to-zone table
+	zones(ctx context.Context) ([]zoneRange, error)
+	// read returns the instances and the zones as read at once
+	read(ctx context.Context) (*inventoryFile, error)
+}
+
+// inventoryFile is the format of an inventory, in a file or the NetloxInventoryKey of the ConfigMap. It is
+// itself the inventory it was read as, so that the lookups of a single sync (e.g. the zones of every node)
+// don't read it again.
+type inventoryFile struct {
+	Instances []instance  `json:"instances"`
+	Zones     []zoneRange `json:"zones,omitempty"`
+}
+
+var _ inventory = &inventoryFile{}
+
+func (f *inventoryFile) instances(ctx context.Context) ([]instance, error) {
+	return f.Instances, nil
+}
+
+func (f *inventoryFile) zones(ctx context.Context) ([]zoneRange, error) {
+	return f.Zones, nil
+}
+
+func (f *inventoryFile) read(ctx context.Context) (*inventoryFile, error) {
+	return f, nil
+}
+
+// parseInventory reads an inventory, as YAML or JSON
+func parseInventory(data []byte) (*inventoryFile, error) {
+	var inv inventoryFile
+	if err := yaml.Unmarshal(data, &inv); err != nil {
+		return nil, err
+	}
+	for x := range inv.Instances {
+		if inv.Instances[x].Name == "" || inv.Instances[x].ID == "" {
+			return nil, fmt.Errorf("instance [%d] needs both a name and an id", x)
+		}
+	}
+	for x := range inv.Zones {
+		if _, _, err := net.ParseCIDR(inv.Zones[x].CIDR); err != nil {
+			return nil, fmt.Errorf("zone [%d] has an invalid cidr : %v", x, err)
+		}
+		if inv.Zones[x].Zone == "" {
+			return nil, fmt.Errorf("zone [%d] needs a zone", x)
+		}
+	}
+	return &inv, nil
+}
+
+// configMapInventory reads the instances from the NetloxInventoryKey of a ConfigMap, listed under
+// "instances:" (and the zones under "zones:") as in an inventory file
+type configMapInventory struct {
+	kubeClient kubernetes.Interface
+	namespace  string
+	name       string
+}
+
+var _ inventory = &configMapInventory{}
+
+func (c *configMapInventory) read(ctx context.Context) (*inventoryFile, error) {
+	cm, err := c.kubeClient.CoreV1().ConfigMaps(c.namespace).Get(ctx, c.name, metav1.GetOptions{})
+	if err != nil {
+		// A missing configMap is an error rather than an empty inventory, which would report every
+		// node as gone and have it deleted
+		return nil, fmt.Errorf("Unable to retrieve inventory configMap [%s] in [%s] : %v", c.name, c.namespace, err)
+	}
+	inv, err := parseInventory([]byte(cm.Data[NetloxInventoryKey]))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read key [%s] of inventory configMap [%s] in [%s] : %v", NetloxInventoryKey, c.name, c.namespace, err)
+	}
+	return inv, nil
+}
+
+func (c *configMapInventory) instances(ctx context.Context) ([]instance, error) {
+	inv, err := c.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return inv.Instances, nil
+}
+
+func (c *configMapInventory) zones(ctx context.Context) ([]zoneRange, error) {
+	inv, err := c.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return inv.Zones, nil
+}
+
+// fileInventory reads the instances from a file, it is read on every lookup so it can be updated in place
+// (e.g. when mounted from a ConfigMap or Secret)
+type fileInventory struct {
+	path string
+}
+
+var _ inventory = &fileInventory{}
+
+func (f *fileInventory) read(ctx context.Context) (*inventoryFile, error) {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read inventory file [%s] : %v", f.path, err)
+	}
+	inv, err := parseInventory(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read inventory file [%s] : %v", f.path, err)
+	}
+	return inv, nil
+}
+
+func (f *fileInventory) instances(ctx context.Context) ([]instance, error) {
+	inv, err := f.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return inv.Instances, nil
+}
+
+func (f *fileInventory) zones(ctx context.Context) ([]zoneRange, error) {
+	inv, err := f.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return inv.Zones, nil
+}
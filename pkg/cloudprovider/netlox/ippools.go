@@ -0,0 +1,257 @@
+package netlox
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+	"netlox.io/netlox/pkg/apis/netlox/v1alpha1"
+	"netlox.io/netlox/pkg/ipam"
+)
+
+// ipPools serves the LoxiIPPool resources from an informer and keeps their status up to date with the
+// allocator
+type ipPools struct {
+	kubeClient kubernetes.Interface
+	client     dynamic.Interface
+	allocator  addressAllocator
+	factory    dynamicinformer.DynamicSharedInformerFactory
+	informer   cache.SharedIndexInformer
+}
+
+func newIPPools(kubeClient kubernetes.Interface, client dynamic.Interface, allocator addressAllocator) *ipPools {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	p := &ipPools{
+		kubeClient: kubeClient,
+		client:     client,
+		allocator:  allocator,
+		factory:    factory,
+		informer:   factory.ForResource(v1alpha1.LoxiIPPoolResource).Informer(),
+	}
+	p.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			p.updateStatus(context.TODO(), obj)
+		},
+		UpdateFunc: func(_, obj interface{}) {
+			p.updateStatus(context.TODO(), obj)
+		},
+	})
+	return p
+}
+
+// installed returns true if the LoxiIPPool CRD is installed in the cluster
+func (p *ipPools) installed() bool {
+	return resourceInstalled(p.kubeClient, v1alpha1.LoxiIPPoolResource)
+}
+
+// start runs the informer until stop is closed, it returns once the pools are synced
+func (p *ipPools) start(stop <-chan struct{}) bool {
+	p.factory.Start(stop)
+	return cache.WaitForCacheSync(stop, p.informer.HasSynced)
+}
+
+// list returns the pools sorted by name
+func (p *ipPools) list() []*v1alpha1.LoxiIPPool {
+	var pools []*v1alpha1.LoxiIPPool
+	for _, obj := range p.informer.GetStore().List() {
+		pool, err := toIPPool(obj)
+		if err != nil {
+			klog.Errorf("Unable to read LoxiIPPool : %v", err)
+			continue
+		}
+		pools = append(pools, pool)
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name < pools[j].Name
+	})
+	return pools
+}
+
+// exists returns true if there is a pool with the name
+func (p *ipPools) exists(name string) bool {
+	_, exists, _ := p.informer.GetStore().GetByKey(name)
+	return exists
+}
+
+// servicePool returns the pool the service is given its address of the family from. That is the pool
+// named by the poolAnnotation, or else the first pool (by name) selecting the service by its labels, then
+// a pool selecting its namespace and then a pool without any selector. nil is returned if there is no such
+// pool.
+func (p *ipPools) servicePool(ctx context.Context, service *v1.Service, family ipam.Family) (*v1alpha1.LoxiIPPool, error) {
+	var candidates []*v1alpha1.LoxiIPPool
+	for _, pool := range p.list() {
+		if servesFamily(pool, family) {
+			candidates = append(candidates, pool)
+		}
+	}
+
+	if name := service.Annotations[poolAnnotation]; name != "" {
+		for _, pool := range candidates {
+			if pool.Name == name {
+				return pool, nil
+			}
+		}
+		return nil, nil
+	}
+
+	var namespaceLabels labels.Set
+	var best *v1alpha1.LoxiIPPool
+	bestRank := 3
+	for _, pool := range candidates {
+		if pool.Spec.NamespaceSelector != nil && namespaceLabels == nil {
+			ns, err := p.kubeClient.CoreV1().Namespaces().Get(ctx, service.Namespace, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("Unable to retrieve namespace [%s] : %v", service.Namespace, err)
+			}
+			namespaceLabels = labels.Set(ns.Labels)
+			if namespaceLabels == nil {
+				namespaceLabels = labels.Set{}
+			}
+		}
+		matches, err := selects(pool, service, namespaceLabels)
+		if err != nil {
+			klog.Errorf("Skipping LoxiIPPool [%s] : %v", pool.Name, err)
+			continue
+		}
+		if !matches {
+			continue
+		}
+
+		rank := 2
+		switch {
+		case pool.Spec.ServiceSelector != nil:
+			rank = 0
+		case pool.Spec.NamespaceSelector != nil:
+			rank = 1
+		}
+		if rank < bestRank {
+			best, bestRank = pool, rank
+		}
+	}
+	return best, nil
+}
+
+// servesFamily returns true if the pool hands out addresses of the family, a pool without an address
+// family serves the families of its cidrs and ranges
+func servesFamily(pool *v1alpha1.LoxiIPPool, family ipam.Family) bool {
+	if pool.Spec.AddressFamily != "" {
+		return ipam.Family(pool.Spec.AddressFamily) == family
+	}
+	for _, entry := range append(append([]string{}, pool.Spec.CIDRs...), pool.Spec.Ranges...) {
+		// The family of a cidr or start-end range is the family of its first address
+		address := strings.SplitN(strings.SplitN(entry, "/", 2)[0], "-", 2)[0]
+		if f, err := ipam.FamilyOf(address); err == nil && f == family {
+			return true
+		}
+	}
+	return false
+}
+
+// selects returns true if the pool selectors match the service and its namespace labels
+func selects(pool *v1alpha1.LoxiIPPool, service *v1.Service, namespaceLabels labels.Set) (bool, error) {
+	if pool.Spec.ServiceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(pool.Spec.ServiceSelector)
+		if err != nil {
+			return false, fmt.Errorf("invalid serviceSelector : %v", err)
+		}
+		if !selector.Matches(labels.Set(service.Labels)) {
+			return false, nil
+		}
+	}
+	if pool.Spec.NamespaceSelector != nil {
+		selector, err := metav1.LabelSelectorAsSelector(pool.Spec.NamespaceSelector)
+		if err != nil {
+			return false, fmt.Errorf("invalid namespaceSelector : %v", err)
+		}
+		if !selector.Matches(namespaceLabels) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// updateAllStatus updates the status of every pool
+func (p *ipPools) updateAllStatus(ctx context.Context) {
+	for _, obj := range p.informer.GetStore().List() {
+		p.updateStatus(ctx, obj)
+	}
+}
+
+// updateStatus updates the capacity, used and free counts of the pool, if they've changed
+func (p *ipPools) updateStatus(ctx context.Context, obj interface{}) {
+	pool, err := toIPPool(obj)
+	if err != nil {
+		klog.Errorf("Unable to read LoxiIPPool : %v", err)
+		return
+	}
+	capacity, used, err := p.allocator.Usage(ipamPool(pool))
+	if err != nil {
+		klog.Errorf("LoxiIPPool [%s] is invalid : %v", pool.Name, err)
+		return
+	}
+	status := v1alpha1.LoxiIPPoolStatus{
+		Capacity: capInt64(capacity),
+		Used:     capInt64(used),
+		Free:     capInt64(new(big.Int).Sub(capacity, used)),
+	}
+	if pool.Status == status {
+		return
+	}
+	pool.Status = status
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		klog.Errorf("Unable to convert LoxiIPPool [%s] : %v", pool.Name, err)
+		return
+	}
+	_, err = p.client.Resource(v1alpha1.LoxiIPPoolResource).UpdateStatus(ctx, &unstructured.Unstructured{Object: content}, metav1.UpdateOptions{})
+	if err != nil {
+		klog.Errorf("Unable to update the status of LoxiIPPool [%s] : %v", pool.Name, err)
+	}
+}
+
+// toIPPool converts an (unstructured) informer object to a LoxiIPPool
+func toIPPool(obj interface{}) (*v1alpha1.LoxiIPPool, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object type %T", obj)
+	}
+	pool := &v1alpha1.LoxiIPPool{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), pool)
+	if err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// ipamPool returns the allocator pool of a LoxiIPPool
+func ipamPool(pool *v1alpha1.LoxiIPPool) ipam.Pool {
+	return ipam.Pool{
+		Name:     fmt.Sprintf("loxiippool/%s", pool.Name),
+		CIDR:     strings.Join(pool.Spec.CIDRs, ","),
+		Range:    strings.Join(pool.Spec.Ranges, ","),
+		Exclude:  strings.Join(pool.Spec.Exclude, ","),
+		Strategy: ipam.Strategy(pool.Spec.Strategy),
+	}
+}
+
+// capInt64 returns the count as an int64, capped at the largest int64 (an IPv6 pool easily has more)
+func capInt64(count *big.Int) int64 {
+	if !count.IsInt64() {
+		return math.MaxInt64
+	}
+	return count.Int64()
+}
@@ -0,0 +1,129 @@
+package netlox
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"netlox.io/netlox/pkg/apis/netlox/v1alpha1"
+	"netlox.io/netlox/pkg/ipam"
+)
+
+func testIPPool(name string, spec v1alpha1.LoxiIPPoolSpec) *unstructured.Unstructured {
+	pool := &v1alpha1.LoxiIPPool{
+		TypeMeta:   metav1.TypeMeta{APIVersion: v1alpha1.SchemeGroupVersion.String(), Kind: "LoxiIPPool"},
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       spec,
+	}
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(pool)
+	if err != nil {
+		panic(err)
+	}
+	return &unstructured.Unstructured{Object: content}
+}
+
+// startTestIPPools sets the LoxiIPPools of the load balancers, the returned func stops the informer
+func startTestIPPools(t *testing.T, lb *loadbalancers, pools ...runtime.Object) (*dynamicfake.FakeDynamicClient, func()) {
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), pools...)
+	stop := make(chan struct{})
+	lb.ipPools = newIPPools(lb.kubeClient, client, lb.allocator)
+	if !lb.ipPools.start(stop) {
+		t.Fatalf("LoxiIPPools didn't sync")
+	}
+	return client, func() { close(stop) }
+}
+
+func TestIPPools_servicePool(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	lb, _ := newTestLoadBalancers(f,
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "a"}}},
+	)
+	_, stop := startTestIPPools(t, lb,
+		testIPPool("catch-all", v1alpha1.LoxiIPPoolSpec{CIDRs: []string{"10.0.0.0/24"}}),
+		testIPPool("public", v1alpha1.LoxiIPPoolSpec{
+			CIDRs:           []string{"10.1.0.0/24"},
+			ServiceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"exposure": "public"}},
+		}),
+		testIPPool("team-a", v1alpha1.LoxiIPPoolSpec{
+			CIDRs:             []string{"10.2.0.0/24"},
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "a"}},
+		}),
+		testIPPool("v6", v1alpha1.LoxiIPPoolSpec{CIDRs: []string{"fd00::/64"}, AddressFamily: v1.IPv6Protocol}),
+	)
+	defer stop()
+
+	tests := []struct {
+		name        string
+		namespace   string
+		labels      map[string]string
+		annotations map[string]string
+		family      ipam.Family
+		want        string
+	}{
+		{name: "no selector matches", namespace: "default", family: ipam.IPv4, want: "catch-all"},
+		{name: "namespace selector", namespace: "team-a", family: ipam.IPv4, want: "team-a"},
+		{name: "service selector first", namespace: "team-a", labels: map[string]string{"exposure": "public"}, family: ipam.IPv4, want: "public"},
+		{name: "annotation", namespace: "team-a", annotations: map[string]string{poolAnnotation: "catch-all"}, family: ipam.IPv4, want: "catch-all"},
+		{name: "unknown annotation", namespace: "default", annotations: map[string]string{poolAnnotation: "internal"}, family: ipam.IPv4},
+		{name: "address family", namespace: "default", family: ipam.IPv6, want: "v6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := testService("web")
+			svc.Namespace = tt.namespace
+			svc.Labels = tt.labels
+			svc.Annotations = tt.annotations
+
+			pool, err := lb.ipPools.servicePool(context.Background(), svc, tt.family)
+			if err != nil {
+				t.Fatalf("servicePool() error = %v", err)
+			}
+			var got string
+			if pool != nil {
+				got = pool.Name
+			}
+			if got != tt.want {
+				t.Errorf("servicePool() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancer_ipPool(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	svc := testService("web", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	lb, _ := newTestLoadBalancers(f, svc)
+	client, stop := startTestIPPools(t, lb,
+		testIPPool("default", v1alpha1.LoxiIPPoolSpec{Ranges: []string{"203.0.113.10-203.0.113.13"}, Exclude: []string{"203.0.113.10"}}),
+	)
+	defer stop()
+
+	status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nil)
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	if vip := status.Ingress[0].IP; vip != "203.0.113.11" {
+		t.Errorf("EnsureLoadBalancer() vip = %s, want 203.0.113.11 from the LoxiIPPool", vip)
+	}
+
+	u, err := client.Resource(v1alpha1.LoxiIPPoolResource).Get(context.Background(), "default", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := toIPPool(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (v1alpha1.LoxiIPPoolStatus{Capacity: 3, Used: 1, Free: 2}); pool.Status != want {
+		t.Errorf("LoxiIPPool status = %+v, want %+v", pool.Status, want)
+	}
+}
@@ -3,14 +3,22 @@ package netlox
 import (
 	"context"
 	"fmt"
-
-	"github.com/plunder-app/plndr-cloud-provider/pkg/ipam"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 
 	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog"
+	"netlox.io/netlox/pkg/ipam"
+	"netlox.io/netlox/pkg/loxilb"
 )
 
 type loxiServices struct {
@@ -18,26 +26,120 @@ type loxiServices struct {
 }
 
 type services struct {
-	Vip         string `json:"vip"`
-	Port        int    `json:"port"`
-	Type        string `json:"type"`
-	UID         string `json:"uid"`
-	ServiceName string `json:"serviceName"`
-	NodePort    int    `json:"nodePort"`
+	// Vip is the primary address of the service, Vips holds one address per IP family of the service
+	// (starting with Vip)
+	Vip  string   `json:"vip"`
+	Vips []string `json:"vips,omitempty"`
+	// Pool is the named pool the VIPs were allocated from, empty for the pool of the namespace
+	Pool        string        `json:"pool,omitempty"`
+	UID         string        `json:"uid"`
+	ServiceName string        `json:"serviceName"`
+	Ports       []portMapping `json:"ports,omitempty"`
+	// Port, Type and NodePort hold the single port mapping recorded by earlier releases, they are only
+	// read (and converted to Ports) when loading the services
+	Port     int    `json:"port,omitempty"`
+	Type     string `json:"type,omitempty"`
+	NodePort int    `json:"nodePort,omitempty"`
+	// Rules records every LoxiLB the service has been programmed on, so that the rules can be removed
+	// even once the node has lost its label or left the cluster
+	Rules []loxiRule `json:"rules,omitempty"`
+	// Namespace of the service, it isn't recorded and is only set on the services returned by list
+	Namespace string `json:"-"`
+	// deleting is set when the record is being deleted, it is then never saved
+	deleting bool
+}
+
+// vips returns every address of the service
+func (s *services) vips() []string {
+	if len(s.Vips) == 0 && s.Vip != "" {
+		return []string{s.Vip}
+	}
+	return s.Vips
+}
+
+// portMapping is a single service port exposed on the VIP
+type portMapping struct {
+	Port     int    `json:"port"`
+	NodePort int    `json:"nodePort"`
+	Protocol string `json:"protocol"`
+}
+
+// loxiRule is a service port rule programmed on a single LoxiLB
+type loxiRule struct {
+	// LoxiLB is the address of the LoxiLB API the rule was programmed through
+	LoxiLB string `json:"loxilb"`
+	// Node is the name of the node running that LoxiLB
+	Node     string `json:"node,omitempty"`
+	Vip      string `json:"vip,omitempty"`
+	Port     int    `json:"port,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+	// Endpoints are the "address:port" backends the rule forwards to
+	Endpoints []string `json:"endpoints,omitempty"`
+}
+
+// key identifies the rule amongst the rules of a service
+func (r loxiRule) key() string {
+	return fmt.Sprintf("%s/%s/%d/%s", r.LoxiLB, r.Vip, r.Port, r.Protocol)
+}
+
+const (
+	// loadBalancerLabel is the label (and loadBalancerLabelValue its value) marking the nodes that run LoxiLB
+	loadBalancerLabel      = "netlox.io/app"
+	loadBalancerLabelValue = "loadbalancer"
+
+	// outsidePoolAnnotation allows a service to request a loadBalancerIP that isn't part of any pool
+	outsidePoolAnnotation = "netlox.io/loadbalancer-ip-outside-pool"
+
+	// ipFamiliesAnnotation lists the IP families (comma seperated, e.g. "IPv4,IPv6") a service is given
+	// a VIP for, the first being the primary family. The service API only has a single ipFamily so this
+	// is how a service asks to be dual-stack.
+	ipFamiliesAnnotation = "netlox.io/ip-families"
+
+	// poolAnnotation names the pool (the "pool-<name>" key of the netlox configMap) a service is given its
+	// addresses from, instead of the pool of its namespace
+	poolAnnotation = "netlox.io/pool"
+)
+
+// supportedProtocols are the service protocols that LoxiLB can load balance
+var supportedProtocols = map[v1.Protocol]bool{
+	v1.ProtocolTCP:  true,
+	v1.ProtocolUDP:  true,
+	v1.ProtocolSCTP: true,
 }
 
 type loadbalancers struct {
-	kubeClient     *kubernetes.Clientset
+	kubeClient kubernetes.Interface
+	client     *netloxClient
+	allocator  addressAllocator
+	// ipPools are the LoxiIPPool resources, nil when the CRD isn't installed
+	ipPools *ipPools
+	// store records the services, in their LoxiLoadBalancer when the CRD is installed or else in the
+	// netlox configMap of their namespace
+	store serviceStore
+	// zones resolves the zone of the nodes without zone labels, nil when Zones isn't enabled
+	zones          *zones
+	usage          poolUsage
+	recorder       record.EventRecorder
 	nameSpace      string
 	cloudConfigMap string
 }
 
-func newLoadBalancers(kubeClient *kubernetes.Clientset, ns, cm, serviceCidr string) cloudprovider.LoadBalancer {
-	return &loadbalancers{
+func newLoadBalancers(kubeClient kubernetes.Interface, client *netloxClient, allocator addressAllocator, ns, cm, serviceCidr string) *loadbalancers {
+	registerIPAMMetrics()
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+
+	lb := &loadbalancers{
 		kubeClient:     kubeClient,
+		client:         client,
+		allocator:      allocator,
+		recorder:       broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "netlox-cloud-controller-manager"}),
 		nameSpace:      ns,
 		cloudConfigMap: cm,
 	}
+	lb.store = &configMapStore{lb: lb}
+	return lb
 }
 
 // Implementations must treat the *v1.Service parameter as read-only and not modify it.
@@ -45,24 +147,14 @@ func newLoadBalancers(kubeClient *kubernetes.Clientset, ns, cm, serviceCidr stri
 func (lb *loadbalancers) GetLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) (status *v1.LoadBalancerStatus, exists bool, err error) {
 	klog.V(5).Info("GetLoadBalancer()")
 
-	// Retrieve the netlox configuration from it's namespace
-	cm, err := lb.GetConfigMap(ctx, NetloxClientConfig, service.Namespace)
-	if err != nil {
-		return nil, true, nil
-	}
-
-	// Find the services configuration in the configMap
-	svc, err := lb.GetServices(cm)
+	existing, err := lb.store.get(ctx, service)
 	if err != nil {
 		return nil, false, err
 	}
-
-	for x := range svc.Services {
-		if svc.Services[x].UID == string(service.UID) {
-			return &service.Status.LoadBalancer, true, nil
-		}
+	if existing == nil {
+		return nil, false, nil
 	}
-	return nil, false, nil
+	return &service.Status.LoadBalancer, true, nil
 }
 
 // GetLoadBalancerName returns the name of the load balancer. Implementations must treat the
@@ -107,30 +199,42 @@ func (lb *loadbalancers) EnsureLoadBalancerDeleted(ctx context.Context, clusterN
 func (lb *loadbalancers) deleteLoadBalancer(ctx context.Context, service *v1.Service) error {
 	klog.Infof("deleting service '%s' (%s)", service.Name, service.UID)
 
-	// Get the netlox (client) configuration from it's namespace
-	cm, err := lb.GetConfigMap(ctx, NetloxClientConfig, service.Namespace)
+	existing, err := lb.store.get(ctx, service)
 	if err != nil {
-		klog.Errorf("The configMap [%s] doensn't exist", NetloxClientConfig)
-		return nil
+		return fmt.Errorf("Unable to retrieve the load balancer of Service [%s] : %v", service.Name, err)
 	}
-	// Find the services configuraiton in the configMap
-	svc, err := lb.GetServices(cm)
-	if err != nil {
-		klog.Errorf("The service [%s] in configMap [%s] doensn't exist", service.Name, NetloxClientConfig)
-		return nil
+
+	// Remove the rules from every LoxiLB the service was programmed on
+	var vips []string
+	if service.Spec.LoadBalancerIP != "" {
+		vips = []string{service.Spec.LoadBalancerIP}
+	}
+	if existing != nil {
+		vips = existing.vips()
+		err = lb.deleteLoxiRules(ctx, existing)
+		if err != nil {
+			// Keep the rules that couldn't be removed so that the retry only targets those, a record being
+			// deleted keeps them all
+			if !existing.deleting {
+				if saveErr := lb.store.save(ctx, service, existing, err); saveErr != nil {
+					klog.Errorln(saveErr)
+				}
+			}
+			return fmt.Errorf("Error removing LoxiLB rules for Service [%s] : %v", service.Name, err)
+		}
 	}
 
-	// Update the services configuration, by removing the  service
-	updatedSvc := svc.delServiceFromUID(string(service.UID))
 	if len(service.Status.LoadBalancer.Ingress) != 0 {
-		err = ipam.ReleaseAddress(service.Namespace, service.Spec.LoadBalancerIP)
-		if err != nil {
-			klog.Errorln(err)
+		for _, vip := range vips {
+			err = lb.allocator.Release(vip)
+			if err != nil {
+				klog.Errorln(err)
+			}
 		}
+		lb.updatePoolUsage(ctx)
 	}
-	// Update the configMap
-	_, err = lb.UpdateConfigMap(ctx, cm, updatedSvc)
-	return err
+	// Remove the service record
+	return lb.store.delete(ctx, service)
 }
 
 func (lb *loadbalancers) syncLoadBalancer(ctx context.Context, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
@@ -148,138 +252,697 @@ func (lb *loadbalancers) syncLoadBalancer(ctx context.Context, service *v1.Servi
 		}
 	}
 
-	// Retrieve the netlox configuration map
-	namespaceCM, err := lb.GetConfigMap(ctx, NetloxClientConfig, service.Namespace)
+	// This function reconciles the load balancer state
+	klog.Infof("syncing service '%s' (%s)", service.Name, service.UID)
+
+	// Reject the ports LoxiLB can't program before anything is allocated or programmed
+	err = validateServicePorts(service)
+	if err != nil {
+		lb.recorder.Event(service, v1.EventTypeWarning, "UnsupportedPorts", err.Error())
+		return nil, err
+	}
+	families, err := serviceIPFamilies(service)
+	if err != nil {
+		lb.recorder.Event(service, v1.EventTypeWarning, "UnsupportedIPFamilies", err.Error())
+		return nil, err
+	}
+
+	// Check for an existing record, an existing service only has its LoxiLB rules reconciled
+	existing, err := lb.store.get(ctx, service)
 	if err != nil {
-		klog.Errorf("Unable to retrieve netlox service cache from configMap [%s] in [%s]", NetloxClientConfig, service.Namespace)
-		// TODO - determine best course of action
-		namespaceCM, err = lb.CreateConfigMap(ctx, NetloxClientConfig, service.Namespace)
+		return nil, fmt.Errorf("Unable to retrieve the load balancer of Service [%s] : %v", service.Name, err)
+	}
+	if existing != nil && existing.deleting {
+		// The record is being deleted while the service still exists, the load balancer is removed with it
+		// and recreated once it is gone
+		err = lb.deleteLoadBalancer(ctx, service)
 		if err != nil {
 			return nil, err
 		}
+		return nil, fmt.Errorf("The load balancer record of Service [%s] is being deleted, it is recreated once it is gone", service.Name)
 	}
+	if existing != nil {
+		klog.Infof("found existing service '%s' (%s) with vip %s", service.Name, service.UID, existing.Vip)
+		existing.Ports = servicePorts(service)
 
-	// This function reconciles the load balancer state
-	klog.Infof("syncing service '%s' (%s)", service.Name, service.UID)
+		syncErr := lb.syncLoxiRules(ctx, existing, nodes)
+		err = lb.store.save(ctx, service, existing, syncErr)
+		if err != nil {
+			return nil, err
+		}
+		if syncErr != nil {
+			return nil, fmt.Errorf("Error programming LoxiLB for Service [%s] : %v", service.Name, syncErr)
+		}
+		return loadBalancerStatus(existing.vips()), nil
+	}
+
+	vips, err := lb.allocateAddresses(ctx, controllerCM, service, families)
+	if err != nil {
+		return nil, err
+	}
+
+	newSvc := services{
+		ServiceName: service.Name,
+		UID:         string(service.UID),
+		Vip:         vips[0],
+		Vips:        vips,
+		Pool:        service.Annotations[poolAnnotation],
+		Ports:       servicePorts(service),
+	}
 
-	// Find the services configuraiton in the configMap
-	svc, err := lb.GetServices(namespaceCM)
+	klog.Infof("Programming service [%s], with load balancer addresses %v", service.Name, vips)
+
+	// Program the rule on every LoxiLB node, whatever was programmed is recorded so that the retry of
+	// a partial failure only needs to reconcile the remaining nodes
+	syncErr := lb.syncLoxiRules(ctx, &newSvc, nodes)
+
+	err = lb.store.save(ctx, service, &newSvc, syncErr)
 	if err != nil {
-		klog.Errorf("Unable to retrieve services from configMap [%s], [%s]", NetloxClientConfig, err.Error())
+		// Nothing records the addresses, so the rules are removed and the addresses released for the retry
+		// to allocate them again. Addresses that are still programmed are kept allocated.
+		if deleteErr := lb.deleteLoxiRules(ctx, &newSvc); deleteErr != nil {
+			klog.Errorf("Unable to remove the rules of Service [%s], its addresses %v stay allocated : %v", service.Name, vips, deleteErr)
+		} else {
+			lb.releaseAddresses(vips)
+			lb.updatePoolUsage(ctx)
+		}
+		return nil, err
+	}
+	if syncErr != nil {
+		return nil, fmt.Errorf("Error programming LoxiLB for Service [%s] : %v", service.Name, syncErr)
+	}
+
+	return loadBalancerStatus(vips), nil
+}
 
-		// TODO best course of action, currently we create a new services config
-		svc = &loxiServices{}
+// loadBalancerStatus returns the status with an ingress for every VIP of the service
+func loadBalancerStatus(vips []string) *v1.LoadBalancerStatus {
+	status := &v1.LoadBalancerStatus{}
+	for _, vip := range vips {
+		status.Ingress = append(status.Ingress, v1.LoadBalancerIngress{IP: vip})
 	}
+	return status
+}
 
-	// Check for existing configuration
+// serviceIPFamilies returns the IP families the service needs a VIP for, the primary family first. They
+// are taken from the ipFamiliesAnnotation, the service ipFamily or the family of the requested
+// loadBalancerIP (in that order) and default to IPv4.
+func serviceIPFamilies(service *v1.Service) ([]ipam.Family, error) {
+	if value, ok := service.Annotations[ipFamiliesAnnotation]; ok {
+		var families []ipam.Family
+		seen := map[ipam.Family]bool{}
+		for _, f := range strings.Split(value, ",") {
+			family := ipam.Family(strings.TrimSpace(f))
+			if family != ipam.IPv4 && family != ipam.IPv6 {
+				return nil, fmt.Errorf("Service [%s] annotation [%s] has an unknown IP family [%s]", service.Name, ipFamiliesAnnotation, f)
+			}
+			if seen[family] {
+				continue
+			}
+			seen[family] = true
+			families = append(families, family)
+		}
+		return families, nil
+	}
+	if service.Spec.IPFamily != nil {
+		return []ipam.Family{ipam.Family(*service.Spec.IPFamily)}, nil
+	}
+	if service.Spec.LoadBalancerIP != "" {
+		if family, err := ipam.FamilyOf(service.Spec.LoadBalancerIP); err == nil {
+			return []ipam.Family{family}, nil
+		}
+	}
+	return []ipam.Family{ipam.IPv4}, nil
+}
 
-	existing := svc.findService(string(service.UID))
-	if existing != nil {
-		klog.Infof("found existing service '%s' (%s) with vip %s", service.Name, service.UID, existing.Vip)
-		return &service.Status.LoadBalancer, nil
+// allocateAddresses returns a VIP for each of the families, the requested loadBalancerIP (if any) is
+// reserved as the address of its family and the other families are allocated from the service pool.
+// Nothing is left allocated if any of the addresses can't be.
+func (lb *loadbalancers) allocateAddresses(ctx context.Context, cm *v1.ConfigMap, service *v1.Service, families []ipam.Family) ([]string, error) {
+	if name := service.Annotations[poolAnnotation]; name != "" {
+		_, ok := cm.Data[namedPoolKey(name)]
+		if !ok && (lb.ipPools == nil || !lb.ipPools.exists(name)) {
+			err := fmt.Errorf("Service [%s] annotation [%s] names pool [%s], but there is no such LoxiIPPool or key [%s] in configMap [%s]", service.Name, poolAnnotation, name, namedPoolKey(name), lb.cloudConfigMap)
+			lb.recorder.Event(service, v1.EventTypeWarning, "UnknownPool", err.Error())
+			return nil, err
+		}
 	}
 
-	if service.Spec.LoadBalancerIP == "" {
-		service.Spec.LoadBalancerIP, err = discoverAddress(controllerCM, service.Namespace, lb.cloudConfigMap)
+	var requested string
+	var requestedFamily ipam.Family
+	if service.Spec.LoadBalancerIP != "" {
+		var err error
+		requested, err = lb.reserveRequestedAddress(ctx, cm, service)
+		if err == nil {
+			requestedFamily, _ = ipam.FamilyOf(requested)
+			if !hasFamily(families, requestedFamily) {
+				lb.releaseAddresses([]string{requested})
+				err = fmt.Errorf("Requested loadBalancerIP [%s] isn't one of the service IP families %v", requested, families)
+			}
+		}
 		if err != nil {
+			lb.recorder.Event(service, v1.EventTypeWarning, "LoadBalancerIPRejected", err.Error())
 			return nil, err
 		}
 	}
 
-	// TODO - manage more than one set of ports
-	newSvc := services{
-		ServiceName: service.Name,
-		UID:         string(service.UID),
-		Type:        string(service.Spec.Ports[0].Protocol),
-		Vip:         service.Spec.LoadBalancerIP,
-		Port:        int(service.Spec.Ports[0].Port),
-		NodePort:    int(service.Spec.Ports[0].NodePort),
+	var vips []string
+	for _, family := range families {
+		if family == requestedFamily {
+			vips = append(vips, requested)
+			continue
+		}
+		vip, err := lb.discoverAddress(ctx, cm, service, family)
+		if err != nil {
+			if requestedFamily != "" {
+				vips = append(vips, requested)
+			}
+			lb.releaseAddresses(vips)
+			return nil, err
+		}
+		vips = append(vips, vip)
 	}
+	lb.updatePoolUsage(ctx)
+	return vips, nil
+}
 
-	klog.Infof("Updating service [%s], with load balancer address [%s]", service.Name, service.Spec.LoadBalancerIP)
+// releaseAddresses releases the addresses, logging the ones that can't be
+func (lb *loadbalancers) releaseAddresses(vips []string) {
+	for _, vip := range vips {
+		if err := lb.allocator.Release(vip); err != nil {
+			klog.Errorln(err)
+		}
+	}
+}
 
-	// FIXME: Error Point Service Update Error
-	_, err = lb.kubeClient.CoreV1().Services(service.Namespace).Update(ctx, service, metav1.UpdateOptions{})
-	if err != nil {
-		// release the address internally as we failed to update service
-		ipamerr := ipam.ReleaseAddress(service.Namespace, service.Spec.LoadBalancerIP)
-		if ipamerr != nil {
-			klog.Errorln(ipamerr)
+// hasFamily returns true if the family is one of the families
+func hasFamily(families []ipam.Family, family ipam.Family) bool {
+	for _, f := range families {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
+
+// servicePorts returns the port mappings exposed by the service
+func servicePorts(service *v1.Service) []portMapping {
+	var ports []portMapping
+	for _, port := range service.Spec.Ports {
+		ports = append(ports, portMapping{
+			Port:     int(port.Port),
+			NodePort: int(port.NodePort),
+			Protocol: string(servicePortProtocol(port)),
+		})
+	}
+	return ports
+}
+
+// servicePortProtocol returns the protocol of the port, defaulting to TCP as the API server does
+func servicePortProtocol(port v1.ServicePort) v1.Protocol {
+	if port.Protocol == "" {
+		return v1.ProtocolTCP
+	}
+	return port.Protocol
+}
+
+// validateServicePorts checks that every port of the service can be programmed on LoxiLB, i.e. it uses
+// a supported protocol, has a nodePort to forward to and isn't a duplicate of another port/protocol
+func validateServicePorts(service *v1.Service) error {
+	if len(service.Spec.Ports) == 0 {
+		return fmt.Errorf("Service [%s] has no ports", service.Name)
+	}
+
+	var errs []error
+	seen := map[string]bool{}
+	for _, port := range service.Spec.Ports {
+		protocol := servicePortProtocol(port)
+		if !supportedProtocols[protocol] {
+			errs = append(errs, fmt.Errorf("port [%d] protocol [%s] isn't supported, only TCP, UDP and SCTP are", port.Port, protocol))
+			continue
+		}
+		if port.NodePort == 0 {
+			errs = append(errs, fmt.Errorf("port [%d/%s] has no nodePort allocated", port.Port, protocol))
+		}
+		key := fmt.Sprintf("%d/%s", port.Port, protocol)
+		if seen[key] {
+			errs = append(errs, fmt.Errorf("port [%s] is defined more than once", key))
+		}
+		seen[key] = true
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("Service [%s] can't be load balanced : %v", service.Name, utilerrors.NewAggregate(errs))
+	}
+	return nil
+}
+
+// desiredLoxiRules returns the rules every node labelled as a LoxiLB node should have, one per VIP and
+// service port with the endpointNodes of the LoxiLB node (and the port's nodePort) as the endpoints
+func desiredLoxiRules(svc *services, nodes []*v1.Node, zones map[string]string) []loxiRule {
+	var rules []loxiRule
+	for _, lbNode := range loadBalancerNodes(nodes) {
+		endpoints := endpointNodes(lbNode, nodes, zones)
+		for _, vip := range svc.vips() {
+			family, _ := ipam.FamilyOf(vip)
+			for _, port := range svc.Ports {
+				rule := loxiRule{
+					LoxiLB:   nodeAddress(lbNode),
+					Node:     lbNode.Name,
+					Vip:      vip,
+					Port:     port.Port,
+					Protocol: port.Protocol,
+				}
+				for _, node := range endpoints {
+					address := nodeAddressOfFamily(node, family)
+					if address == "" {
+						klog.Warningf("Node [%s] has no address, skipping it as an endpoint", node.Name)
+						continue
+					}
+					rule.Endpoints = append(rule.Endpoints, net.JoinHostPort(address, strconv.Itoa(port.NodePort)))
+				}
+				sort.Strings(rule.Endpoints)
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules
+}
+
+// endpointNodes returns the nodes the LoxiLB node forwards traffic to, the other nodes in its zone or
+// every other node when it has no zone or is the only node of its zone
+func endpointNodes(lbNode *v1.Node, nodes []*v1.Node, zones map[string]string) []*v1.Node {
+	var all, sameZone []*v1.Node
+	zone := zones[lbNode.Name]
+	for _, node := range nodes {
+		if node.Name == lbNode.Name {
+			continue
+		}
+		all = append(all, node)
+		if zone != "" && zones[node.Name] == zone {
+			sameZone = append(sameZone, node)
+		}
+	}
+	if len(sameZone) != 0 {
+		return sameZone
+	}
+	return all
+}
+
+// nodeZones returns the zone of the nodes that have one, read from the zone labels the cloud node
+// controller sets when it initializes a node, or else resolved by lb.zones (e.g. for the nodes that were
+// initialized before Zones was enabled). The inventory is read at most once for all the nodes.
+func (lb *loadbalancers) nodeZones(ctx context.Context, nodes []*v1.Node) map[string]string {
+	zoneOf := map[string]string{}
+	var resolver *zones
+	for _, node := range nodes {
+		zone := node.Labels[v1.LabelZoneFailureDomainStable]
+		if zone == "" {
+			zone = node.Labels[v1.LabelZoneFailureDomain]
+		}
+		if zone == "" && lb.zones != nil {
+			if resolver == nil {
+				var err error
+				resolver, err = lb.zones.snapshot(ctx)
+				if err != nil {
+					klog.Warningf("Unable to read the inventory, the zones of the nodes are only read from their labels : %v", err)
+					resolver = newZones(lb.zones.kubeClient, nil, lb.zones.sources)
+				}
+			}
+			z, err := resolver.zoneOfNode(ctx, node)
+			if err != nil {
+				klog.Warningf("Unable to resolve the zone of node [%s], it is treated as in no zone : %v", node.Name, err)
+			}
+			zone = z.FailureDomain
+		}
+		if zone != "" {
+			zoneOf[node.Name] = zone
 		}
-		klog.Info(fmt.Errorf("Error syncLoadBalancer() : %+v", service.Status.LoadBalancer))
-		return nil, fmt.Errorf("Error updating Service Spec [%s] : %v", service.Name, err)
+	}
+	return zoneOf
+}
+
+// syncLoxiRules reconciles the rules recorded in svc.Rules against the desired rules for the nodes and
+// service ports. Rules that are new are programmed, those for LoxiLB nodes that are no longer labelled
+// (or gone) or for ports that were removed are deleted and those whose endpoints changed are updated in
+// place; unchanged rules aren't touched. Every rule is attempted and the failures are aggregated,
+// svc.Rules is updated to what is programmed.
+func (lb *loadbalancers) syncLoxiRules(ctx context.Context, svc *services, nodes []*v1.Node) error {
+	desired := desiredLoxiRules(svc, nodes, lb.nodeZones(ctx, nodes))
+	if len(desired) == 0 {
+		klog.Warningf("No nodes labelled [%s=%s], service [%s] isn't programmed on any LoxiLB", loadBalancerLabel, loadBalancerLabelValue, svc.ServiceName)
 	}
 
-	nodePort := service.Spec.Ports[0].NodePort
+	programmed := map[string]loxiRule{}
+	for _, rule := range svc.Rules {
+		programmed[rule.key()] = rule
+	}
 
-	klog.Info(fmt.Errorf("Labels of Node Lists() : %+v", nodes[0].ObjectMeta.Labels))
-	svc.addService(newSvc, nodes, nodePort)
+	var rules []loxiRule
+	var errs []error
+	for _, rule := range desired {
+		current, ok := programmed[rule.key()]
+		delete(programmed, rule.key())
+		if ok && reflect.DeepEqual(current.Endpoints, rule.Endpoints) {
+			rules = append(rules, current)
+			continue
+		}
 
-	namespaceCM, err = lb.UpdateConfigMap(ctx, namespaceCM, svc)
+		err := lb.createLoxiRule(ctx, rule)
+		if err != nil {
+			klog.Errorf("Unable to program service [%s] port [%d/%s] on LoxiLB node [%s] : %v", svc.ServiceName, rule.Port, rule.Protocol, rule.Node, err)
+			errs = append(errs, fmt.Errorf("node [%s] port [%d/%s] : %v", rule.Node, rule.Port, rule.Protocol, err))
+			if ok {
+				// Keep the previous state, it is still what LoxiLB has programmed
+				rules = append(rules, current)
+			}
+			continue
+		}
+		klog.Infof("Programmed service [%s] port [%d/%s] on LoxiLB node [%s] with [%d] endpoints", svc.ServiceName, rule.Port, rule.Protocol, rule.Node, len(rule.Endpoints))
+		rules = append(rules, rule)
+	}
+
+	// Anything left over is programmed on a LoxiLB (or for a port) that should no longer have the service
+	stale := &services{
+		ServiceName: svc.ServiceName,
+	}
+	for _, rule := range svc.Rules {
+		if _, ok := programmed[rule.key()]; ok {
+			stale.Rules = append(stale.Rules, rule)
+		}
+	}
+	if len(stale.Rules) != 0 {
+		if err := lb.deleteLoxiRules(ctx, stale); err != nil {
+			errs = append(errs, err)
+		}
+		rules = append(rules, stale.Rules...)
+	}
+
+	svc.Rules = rules
+	return utilerrors.NewAggregate(errs)
+}
+
+// releaseRecord removes the rules of a record left by an earlier service of the same name and releases its
+// VIPs, svc.Rules is left with only the rules that couldn't be removed.
+func (lb *loadbalancers) releaseRecord(ctx context.Context, svc *services) error {
+	err := lb.deleteLoxiRules(ctx, svc)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	lb.releaseAddresses(svc.vips())
+	lb.updatePoolUsage(ctx)
+	return nil
+}
 
-	klog.Info(fmt.Errorf("Complete syncLoadBalancer() : %+v", service.Status.LoadBalancer))
+// deleteLoxiRules removes every rule recorded for the service, svc.Rules is left with only the rules
+// that couldn't be removed.
+func (lb *loadbalancers) deleteLoxiRules(ctx context.Context, svc *services) error {
+	var remaining []loxiRule
+	var errs []error
+	for _, rule := range svc.Rules {
+		err := lb.deleteLoxiRule(ctx, rule)
+		if err != nil {
+			klog.Errorf("Unable to remove service [%s] port [%d/%s] from LoxiLB [%s] (node [%s]) : %v", svc.ServiceName, rule.Port, rule.Protocol, rule.LoxiLB, rule.Node, err)
+			errs = append(errs, fmt.Errorf("LoxiLB [%s] port [%d/%s] : %v", rule.LoxiLB, rule.Port, rule.Protocol, err))
+			remaining = append(remaining, rule)
+			continue
+		}
+		klog.Infof("Removed service [%s] port [%d/%s] from LoxiLB [%s] (node [%s])", svc.ServiceName, rule.Port, rule.Protocol, rule.LoxiLB, rule.Node)
+	}
+	svc.Rules = remaining
+	return utilerrors.NewAggregate(errs)
+}
 
-	// return &service.Status.LoadBalancer, nil
-	return &v1.LoadBalancerStatus{
-		Ingress: []v1.LoadBalancerIngress{
-			{
-				IP: service.Spec.LoadBalancerIP,
-			},
+// loxiEndpoints converts the recorded "address:port" endpoints to LoxiLB endpoints
+func loxiEndpoints(endpoints []string) []loxilb.Endpoint {
+	var eps []loxilb.Endpoint
+	for _, endpoint := range endpoints {
+		host, port, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			klog.Errorf("Unable to parse endpoint [%s] : %v", endpoint, err)
+			continue
+		}
+		targetPort, _ := strconv.Atoi(port)
+		eps = append(eps, loxilb.Endpoint{
+			EndpointIP: host,
+			TargetPort: int32(targetPort),
+			Weight:     1,
+		})
+	}
+	return eps
+}
+
+// createLoxiRule programs the rule VIP and port on the LoxiLB the rule is for, forwarding traffic to the
+// rule endpoints. LoxiLB updates the endpoints of an existing rule in place, but when it rejects the rule
+// as already existing the programmed endpoints are compared: a rule with the same endpoints is not treated
+// as an error, otherwise it is deleted and created again with the rule endpoints.
+func (lb *loadbalancers) createLoxiRule(ctx context.Context, rule loxiRule) error {
+	client, err := lb.client.loxiLB(rule.LoxiLB)
+	if err != nil {
+		return err
+	}
+	lbRule := &loxilb.LoadBalancer{
+		ServiceArguments: loxilb.ServiceArguments{
+			ExternalIP: rule.Vip,
+			Port:       int32(rule.Port),
+			Protocol:   strings.ToLower(rule.Protocol),
 		},
-	}, nil
+		Endpoints: loxiEndpoints(rule.Endpoints),
+	}
+	err = client.CreateLoadBalancer(ctx, lbRule)
+	if !loxilb.IsAlreadyExists(err) {
+		return err
+	}
+
+	existing, err := client.GetLoadBalancer(ctx, rule.Vip, int32(rule.Port), rule.Protocol)
+	if err != nil {
+		return fmt.Errorf("Unable to retrieve the existing rule for [%s:%d/%s] : %v", rule.Vip, rule.Port, rule.Protocol, err)
+	}
+	if reflect.DeepEqual(programmedEndpoints(existing), rule.Endpoints) {
+		klog.Infof("rule for [%s:%d/%s] already exists on LoxiLB [%s]", rule.Vip, rule.Port, rule.Protocol, rule.LoxiLB)
+		return nil
+	}
+	klog.Infof("rule for [%s:%d/%s] already exists on LoxiLB [%s] with other endpoints, recreating it", rule.Vip, rule.Port, rule.Protocol, rule.LoxiLB)
+	err = client.DeleteLoadBalancer(ctx, rule.Vip, int32(rule.Port), rule.Protocol)
+	if err != nil && !loxilb.IsNotFound(err) {
+		return err
+	}
+	return client.CreateLoadBalancer(ctx, lbRule)
+}
+
+// programmedEndpoints returns the sorted "address:port" endpoints of a rule programmed on LoxiLB, in the
+// form they are recorded
+func programmedEndpoints(lbRule *loxilb.LoadBalancer) []string {
+	var endpoints []string
+	for _, ep := range lbRule.Endpoints {
+		endpoints = append(endpoints, net.JoinHostPort(ep.EndpointIP, strconv.Itoa(int(ep.TargetPort))))
+	}
+	sort.Strings(endpoints)
+	return endpoints
+}
+
+// deleteLoxiRule removes the rule VIP and port from the LoxiLB the rule is for, a rule that doesn't exist
+// is not treated as an error.
+func (lb *loadbalancers) deleteLoxiRule(ctx context.Context, rule loxiRule) error {
+	client, err := lb.client.loxiLB(rule.LoxiLB)
+	if err != nil {
+		return err
+	}
+	err = client.DeleteLoadBalancer(ctx, rule.Vip, int32(rule.Port), rule.Protocol)
+	if loxilb.IsNotFound(err) {
+		klog.Infof("rule for [%s:%d/%s] doesn't exist on LoxiLB [%s]", rule.Vip, rule.Port, rule.Protocol, rule.LoxiLB)
+		return nil
+	}
+	return err
 }
 
-func discoverAddress(cm *v1.ConfigMap, namespace, configMapName string) (vip string, err error) {
-	var cidr, ipRange string
-	var ok bool
+// loadBalancerNodes returns the nodes that are labelled as running LoxiLB
+func loadBalancerNodes(nodes []*v1.Node) []*v1.Node {
+	var lbNodes []*v1.Node
+	for _, node := range nodes {
+		if node.Labels[loadBalancerLabel] == loadBalancerLabelValue {
+			lbNodes = append(lbNodes, node)
+		}
+	}
+	return lbNodes
+}
+
+// nodeAddress returns the address used to reach a node, preferring the InternalIP
+func nodeAddress(node *v1.Node) string {
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == v1.NodeInternalIP {
+			return addr.Address
+		}
+	}
+	if len(node.Status.Addresses) != 0 {
+		return node.Status.Addresses[0].Address
+	}
+	return ""
+}
 
+// nodeAddressOfFamily returns the address used to reach a node from a VIP of the family, preferring the
+// InternalIP of that family. A node without an address of the family falls back to nodeAddress, leaving
+// LoxiLB to translate between the families.
+func nodeAddressOfFamily(node *v1.Node, family ipam.Family) string {
+	var address string
+	for _, addr := range node.Status.Addresses {
+		if f, err := ipam.FamilyOf(addr.Address); err != nil || f != family {
+			continue
+		}
+		if addr.Type == v1.NodeInternalIP {
+			return addr.Address
+		}
+		if address == "" {
+			address = addr.Address
+		}
+	}
+	if address != "" {
+		return address
+	}
+	return nodeAddress(node)
+}
+
+// discoverPool returns the pool that addresses are allocated from, the named pool (when a poolName is
+// passed) or else the pool of the namespace, where a cidr for the namespace (or the global cidr) takes
+// precedence over a range for the namespace (or the global range).
+// The allocation strategy of the pool is set by the "strategy-<pool key>" key (e.g. strategy-cidr-global)
+// and the addresses excluded from it by the "exclude-<namespace>" (or "exclude-global") key matching the
+// pool, or the "exclude-pool-<name>" key for a named pool.
+func discoverPool(cm *v1.ConfigMap, namespace, poolName, configMapName string) (*ipam.Pool, error) {
+	var pool *ipam.Pool
+	var err error
+	if poolName != "" {
+		pool, err = lookupNamedPool(cm, poolName, configMapName)
+	} else {
+		pool, err = lookupPool(cm, namespace, configMapName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if strategy, ok := cm.Data[fmt.Sprintf("strategy-%s", pool.Name)]; ok {
+		pool.Strategy = ipam.Strategy(strategy)
+	}
+	if poolName != "" {
+		pool.Exclude = cm.Data[fmt.Sprintf("exclude-%s", pool.Name)]
+	} else {
+		// The pool key is cidr-<scope> or range-<scope>
+		scope := strings.SplitN(pool.Name, "-", 2)[1]
+		pool.Exclude = cm.Data[fmt.Sprintf("exclude-%s", scope)]
+	}
+	return pool, nil
+}
+
+// namedPoolKey returns the configMap key of a named pool
+func namedPoolKey(name string) string {
+	return fmt.Sprintf("pool-%s", name)
+}
+
+// lookupNamedPool returns the named pool, its key holds cidrs and/or start-end ranges (comma seperated)
+func lookupNamedPool(cm *v1.ConfigMap, name, configMapName string) (*ipam.Pool, error) {
+	key := namedPoolKey(name)
+	value, ok := cm.Data[key]
+	if !ok {
+		return nil, fmt.Errorf("No pool [%s] exists in key [%s] configmap [%s]", name, key, configMapName)
+	}
+	klog.Infof("Taking address from [%s] pool", key)
+
+	var cidrs, ranges []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			cidrs = append(cidrs, entry)
+		} else {
+			ranges = append(ranges, entry)
+		}
+	}
+	return &ipam.Pool{Name: key, CIDR: strings.Join(cidrs, ","), Range: strings.Join(ranges, ",")}, nil
+}
+
+// lookupPool returns the pool for the namespace (see discoverPool)
+func lookupPool(cm *v1.ConfigMap, namespace, configMapName string) (*ipam.Pool, error) {
 	// Find Cidr
 	cidrKey := fmt.Sprintf("cidr-%s", namespace)
 	// Lookup current namespace
-	if cidr, ok = cm.Data[cidrKey]; !ok {
-		klog.Info(fmt.Errorf("No cidr config for namespace [%s] exists in key [%s] configmap [%s]", namespace, cidrKey, configMapName))
-		// Lookup global cidr configmap data
-		if cidr, ok = cm.Data["cidr-global"]; !ok {
-			klog.Info(fmt.Errorf("No global cidr config exists [cidr-global]"))
-		} else {
-			klog.Infof("Taking address from [cidr-global] pool")
-		}
-	} else {
+	if cidr, ok := cm.Data[cidrKey]; ok {
 		klog.Infof("Taking address from [%s] pool", cidrKey)
+		return &ipam.Pool{Name: cidrKey, CIDR: cidr}, nil
 	}
-	if ok {
-		vip, err = ipam.FindAvailableHostFromCidr(namespace, cidr)
-		if err != nil {
-			return "", err
-		}
-		return
+	klog.Info(fmt.Errorf("No cidr config for namespace [%s] exists in key [%s] configmap [%s]", namespace, cidrKey, configMapName))
+	// Lookup global cidr configmap data
+	if cidr, ok := cm.Data["cidr-global"]; ok {
+		klog.Infof("Taking address from [cidr-global] pool")
+		return &ipam.Pool{Name: "cidr-global", CIDR: cidr}, nil
 	}
+	klog.Info(fmt.Errorf("No global cidr config exists [cidr-global]"))
 
 	// Find Range
 	rangeKey := fmt.Sprintf("range-%s", namespace)
 	// Lookup current namespace
-	if ipRange, ok = cm.Data[rangeKey]; !ok {
-		klog.Info(fmt.Errorf("No range config for namespace [%s] exists in key [%s] configmap [%s]", namespace, rangeKey, configMapName))
-		// Lookup global range configmap data
-		if ipRange, ok = cm.Data["range-global"]; !ok {
-			klog.Info(fmt.Errorf("No global range config exists [range-global]"))
-		} else {
-			klog.Infof("Taking address from [range-global] pool")
-		}
-	} else {
+	if ipRange, ok := cm.Data[rangeKey]; ok {
 		klog.Infof("Taking address from [%s] pool", rangeKey)
+		return &ipam.Pool{Name: rangeKey, Range: ipRange}, nil
+	}
+	klog.Info(fmt.Errorf("No range config for namespace [%s] exists in key [%s] configmap [%s]", namespace, rangeKey, configMapName))
+	// Lookup global range configmap data
+	if ipRange, ok := cm.Data["range-global"]; ok {
+		klog.Infof("Taking address from [range-global] pool")
+		return &ipam.Pool{Name: "range-global", Range: ipRange}, nil
 	}
-	if ok {
-		vip, err = ipam.FindAvailableHostFromRange(namespace, ipRange)
+	klog.Info(fmt.Errorf("No global range config exists [range-global]"))
+
+	return nil, fmt.Errorf("No IP address ranges could be found either range-global or range-<namespace>")
+}
+
+// servicePool returns the pool the service is given its address of the family from, a LoxiIPPool (when the
+// CRD is installed) takes precedence over the pools of the netlox configMap
+func (lb *loadbalancers) servicePool(ctx context.Context, cm *v1.ConfigMap, service *v1.Service, family ipam.Family) (*ipam.Pool, error) {
+	if lb.ipPools != nil {
+		pool, err := lb.ipPools.servicePool(ctx, service, family)
 		if err != nil {
-			return vip, err
+			return nil, err
+		}
+		if pool != nil {
+			klog.Infof("Taking address from LoxiIPPool [%s]", pool.Name)
+			p := ipamPool(pool)
+			lb.usage.seen(p)
+			return &p, nil
+		}
+	}
+	if cm == nil {
+		return nil, fmt.Errorf("No pool for service [%s] and no configMap [%s]", service.Name, lb.cloudConfigMap)
+	}
+	pool, err := discoverPool(cm, service.Namespace, service.Annotations[poolAnnotation], lb.cloudConfigMap)
+	if err != nil {
+		return nil, err
+	}
+	lb.usage.seen(*pool)
+	return pool, nil
+}
+
+// updatePoolUsage updates the usage reported by the pool metrics and every LoxiIPPool
+func (lb *loadbalancers) updatePoolUsage(ctx context.Context) {
+	lb.usage.update(lb.allocator)
+	if lb.ipPools != nil {
+		lb.ipPools.updateAllStatus(ctx)
+	}
+}
+
+// discoverAddress allocates an address of the family from the service pool, a failure is counted and
+// raised as an event on the service
+func (lb *loadbalancers) discoverAddress(ctx context.Context, cm *v1.ConfigMap, service *v1.Service, family ipam.Family) (vip string, err error) {
+	pool, err := lb.servicePool(ctx, cm, service, family)
+	if err == nil {
+		vip, err = lb.allocator.Allocate(*pool, family, serviceOwner(service))
+	}
+	if err != nil {
+		poolName := ""
+		if pool != nil {
+			poolName = pool.Name
 		}
-		return
+		allocationFailures.WithLabelValues(poolName, service.Namespace).Inc()
+		lb.recorder.Event(service, v1.EventTypeWarning, "AllocationFailed", err.Error())
+		return "", err
 	}
-	return "", fmt.Errorf("No IP address ranges could be found either range-global or range-<namespace>")
+	return vip, nil
 }
 
 //////////////////////////////////////////// sample lb with explanation of lifecycle ///////////////////////////////////////////////
@@ -0,0 +1,729 @@
+package netlox
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"netlox.io/netlox/pkg/ipam"
+)
+
+func newTestLoadBalancers(f *fakeLoxiLB, objects ...runtime.Object) (*loadbalancers, *fake.Clientset) {
+	controllerCM := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: NetloxCloudConfig, Namespace: "kube-system"},
+		Data: map[string]string{
+			"cidr-global": "192.168.0.200/24",
+		},
+	}
+	kubeClient := fake.NewSimpleClientset(append(objects, controllerCM)...)
+	lb := newLoadBalancers(kubeClient, f.client(), ipam.NewAllocator(), "kube-system", NetloxCloudConfig, "")
+	lb.recorder = record.NewFakeRecorder(10)
+	return lb, kubeClient
+}
+
+func testNode(name, address string, loadBalancer bool) *v1.Node {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{}},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{
+				{Type: v1.NodeHostName, Address: name},
+				{Type: v1.NodeInternalIP, Address: address},
+			},
+		},
+	}
+	if loadBalancer {
+		node.Labels[loadBalancerLabel] = loadBalancerLabelValue
+	}
+	return node
+}
+
+func testService(name string, ports ...v1.ServicePort) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(name + "-uid")},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeLoadBalancer,
+			Ports: ports,
+		},
+	}
+}
+
+func TestEnsureLoadBalancer_programsEveryLoadBalancerNode(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	svc := testService("nginx", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	lb, _ := newTestLoadBalancers(f, svc)
+	nodes := []*v1.Node{
+		testNode("lb-1", "10.0.0.1", true),
+		testNode("worker-1", "10.0.0.2", false),
+		testNode("worker-2", "10.0.0.3", false),
+		testNode("lb-2", "10.0.0.4", true),
+	}
+
+	status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	vip := status.Ingress[0].IP
+
+	want := map[string][]string{
+		"10.0.0.1": {"10.0.0.2:30080", "10.0.0.3:30080", "10.0.0.4:30080"},
+		"10.0.0.4": {"10.0.0.1:30080", "10.0.0.2:30080", "10.0.0.3:30080"},
+	}
+	for address, endpoints := range want {
+		if got := f.endpoints(address, vip, 80, "tcp"); !reflect.DeepEqual(got, endpoints) {
+			t.Errorf("endpoints on [%s] = %v, want %v", address, got, endpoints)
+		}
+	}
+	for _, address := range []string{"10.0.0.2", "10.0.0.3"} {
+		if f.count(address) != 0 {
+			t.Errorf("rules programmed on non load balancer node [%s]", address)
+		}
+	}
+}
+
+func TestEnsureLoadBalancer_aggregatesNodeErrors(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+	f.setFailing("10.0.0.4", true)
+
+	svc := testService("nginx", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	lb, _ := newTestLoadBalancers(f, svc)
+	nodes := []*v1.Node{
+		testNode("lb-1", "10.0.0.1", true),
+		testNode("worker-1", "10.0.0.2", false),
+		testNode("lb-2", "10.0.0.4", true),
+	}
+
+	_, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+	if err == nil || !strings.Contains(err.Error(), "lb-2") || strings.Contains(err.Error(), "lb-1") {
+		t.Fatalf("EnsureLoadBalancer() error = %v, want an error for lb-2 only", err)
+	}
+	if f.count("10.0.0.1") != 1 {
+		t.Errorf("healthy LoxiLB node wasn't programmed")
+	}
+
+	// The retry only has to program lb-2
+	f.setFailing("10.0.0.4", false)
+	if _, err = lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes); err != nil {
+		t.Fatalf("EnsureLoadBalancer() retry error = %v", err)
+	}
+	if f.count("10.0.0.4") != 1 {
+		t.Errorf("retry didn't program the failed LoxiLB node")
+	}
+	if f.writeCount("10.0.0.1") != 1 {
+		t.Errorf("retry reprogrammed the healthy LoxiLB node")
+	}
+}
+
+func TestUpdateLoadBalancer_reconcilesEndpoints(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	svc := testService("nginx", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	lb, _ := newTestLoadBalancers(f, svc)
+	lb1 := testNode("lb-1", "10.0.0.1", true)
+	lb2 := testNode("lb-2", "10.0.0.4", true)
+	worker1 := testNode("worker-1", "10.0.0.2", false)
+	worker2 := testNode("worker-2", "10.0.0.3", false)
+
+	status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, []*v1.Node{lb1, worker1})
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	vip := status.Ingress[0].IP
+
+	tests := []struct {
+		name       string
+		nodes      []*v1.Node
+		want       map[string][]string
+		wantWrites map[string]int
+	}{
+		{
+			name:       "unchanged nodes",
+			nodes:      []*v1.Node{lb1, worker1},
+			want:       map[string][]string{"10.0.0.1": {"10.0.0.2:30080"}},
+			wantWrites: map[string]int{"10.0.0.1": 1},
+		},
+		{
+			name:       "worker added",
+			nodes:      []*v1.Node{lb1, worker1, worker2},
+			want:       map[string][]string{"10.0.0.1": {"10.0.0.2:30080", "10.0.0.3:30080"}},
+			wantWrites: map[string]int{"10.0.0.1": 2},
+		},
+		{
+			name:  "load balancer added",
+			nodes: []*v1.Node{lb1, worker1, worker2, lb2},
+			want: map[string][]string{
+				"10.0.0.1": {"10.0.0.2:30080", "10.0.0.3:30080", "10.0.0.4:30080"},
+				"10.0.0.4": {"10.0.0.1:30080", "10.0.0.2:30080", "10.0.0.3:30080"},
+			},
+			wantWrites: map[string]int{"10.0.0.1": 3, "10.0.0.4": 1},
+		},
+		{
+			name:  "worker drained",
+			nodes: []*v1.Node{lb1, worker2, lb2},
+			want: map[string][]string{
+				"10.0.0.1": {"10.0.0.3:30080", "10.0.0.4:30080"},
+				"10.0.0.4": {"10.0.0.1:30080", "10.0.0.3:30080"},
+			},
+			wantWrites: map[string]int{"10.0.0.1": 4, "10.0.0.4": 2},
+		},
+		{
+			name:       "load balancer removed",
+			nodes:      []*v1.Node{lb2, worker2},
+			want:       map[string][]string{"10.0.0.4": {"10.0.0.3:30080"}},
+			wantWrites: map[string]int{"10.0.0.1": 5, "10.0.0.4": 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := lb.UpdateLoadBalancer(context.Background(), "kubernetes", svc, tt.nodes); err != nil {
+				t.Fatalf("UpdateLoadBalancer() error = %v", err)
+			}
+			for address, endpoints := range tt.want {
+				if got := f.endpoints(address, vip, 80, "tcp"); !reflect.DeepEqual(got, endpoints) {
+					t.Errorf("endpoints on [%s] = %v, want %v", address, got, endpoints)
+				}
+			}
+			for address, writes := range tt.wantWrites {
+				if got := f.writeCount(address); got != writes {
+					t.Errorf("writes to [%s] = %d, want %d", address, got, writes)
+				}
+			}
+			entry := findTestService(t, lb, svc)
+			if len(entry.Rules) != len(tt.want) {
+				t.Errorf("recorded rules = %+v, want %d", entry.Rules, len(tt.want))
+			}
+		})
+	}
+	if f.count("10.0.0.1") != 0 {
+		t.Errorf("rule wasn't removed from the unlabelled LoxiLB")
+	}
+}
+
+func TestUpdateLoadBalancer_recreatesExistingRule(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+	f.setRejectExisting(true)
+
+	svc := testService("nginx", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	lb, _ := newTestLoadBalancers(f, svc)
+	lb1 := testNode("lb-1", "10.0.0.1", true)
+	worker1 := testNode("worker-1", "10.0.0.2", false)
+	worker2 := testNode("worker-2", "10.0.0.3", false)
+
+	status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, []*v1.Node{lb1, worker1})
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	vip := status.Ingress[0].IP
+
+	// LoxiLB rejects the rule with the new endpoints as already existing, it is recreated
+	if err := lb.UpdateLoadBalancer(context.Background(), "kubernetes", svc, []*v1.Node{lb1, worker1, worker2}); err != nil {
+		t.Fatalf("UpdateLoadBalancer() error = %v", err)
+	}
+	want := []string{"10.0.0.2:30080", "10.0.0.3:30080"}
+	if got := f.endpoints("10.0.0.1", vip, 80, "tcp"); !reflect.DeepEqual(got, want) {
+		t.Errorf("endpoints = %v, want %v", got, want)
+	}
+	if entry := findTestService(t, lb, svc); len(entry.Rules) != 1 || !reflect.DeepEqual(entry.Rules[0].Endpoints, want) {
+		t.Errorf("recorded rules = %+v, want endpoints %v", entry.Rules, want)
+	}
+
+	// A rule that exists with the same endpoints (e.g. the record was lost) is left alone
+	writes := f.writeCount("10.0.0.1")
+	if err := lb.createLoxiRule(context.Background(), loxiRule{LoxiLB: "10.0.0.1", Node: "lb-1", Vip: vip, Port: 80, Protocol: "TCP", Endpoints: want}); err != nil {
+		t.Errorf("createLoxiRule() error = %v", err)
+	}
+	if got := f.writeCount("10.0.0.1"); got != writes+1 {
+		t.Errorf("writes = %d, want only the rejected create", got-writes)
+	}
+}
+
+func TestEnsureLoadBalancerDeleted_removesRecordedRules(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	svc := testService("nginx", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	lb, _ := newTestLoadBalancers(f, svc)
+	nodes := []*v1.Node{
+		testNode("lb-1", "10.0.0.1", true),
+		testNode("worker-1", "10.0.0.2", false),
+		testNode("lb-2", "10.0.0.4", true),
+	}
+	if _, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes); err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+
+	// lb-2 can't be reached while deleting, its rule must be kept for the retry
+	f.setFailing("10.0.0.4", true)
+	if err := lb.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc); err == nil {
+		t.Fatalf("EnsureLoadBalancerDeleted() expected an error for lb-2")
+	}
+	if f.count("10.0.0.1") != 0 {
+		t.Errorf("rule wasn't removed from lb-1")
+	}
+	entry := findTestService(t, lb, svc)
+	if entry == nil || len(entry.Rules) != 1 || entry.Rules[0].Node != "lb-2" {
+		t.Fatalf("recorded rules = %+v, want only lb-2", entry)
+	}
+
+	f.setFailing("10.0.0.4", false)
+	if err := lb.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc); err != nil {
+		t.Fatalf("EnsureLoadBalancerDeleted() retry error = %v", err)
+	}
+	if f.count("10.0.0.4") != 0 {
+		t.Errorf("rule wasn't removed from lb-2")
+	}
+	if entry = findTestService(t, lb, svc); entry != nil {
+		t.Errorf("service is still recorded: %+v", entry)
+	}
+}
+
+// findTestService returns the recorded state of the service
+func findTestService(t *testing.T, lb *loadbalancers, service *v1.Service) *services {
+	cm, err := lb.GetConfigMap(context.Background(), NetloxClientConfig, service.Namespace)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	svcs, err := lb.GetServices(cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svcs.findService(string(service.UID))
+}
+
+func TestUpdateLoadBalancer_multiplePorts(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	svc := testService("web",
+		v1.ServicePort{Name: "http", Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP},
+		v1.ServicePort{Name: "https", Port: 443, NodePort: 30443, Protocol: v1.ProtocolTCP},
+	)
+	lb, _ := newTestLoadBalancers(f, svc)
+	nodes := []*v1.Node{
+		testNode("lb-1", "10.0.0.1", true),
+		testNode("worker-1", "10.0.0.2", false),
+	}
+
+	status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	vip := status.Ingress[0].IP
+	if got := f.endpoints("10.0.0.1", vip, 80, "tcp"); !reflect.DeepEqual(got, []string{"10.0.0.2:30080"}) {
+		t.Errorf("endpoints for port 80 = %v", got)
+	}
+	if got := f.endpoints("10.0.0.1", vip, 443, "tcp"); !reflect.DeepEqual(got, []string{"10.0.0.2:30443"}) {
+		t.Errorf("endpoints for port 443 = %v", got)
+	}
+
+	// A port added to the service is picked up and a removed one is cleaned up
+	updated := svc.DeepCopy()
+	updated.Spec.Ports = []v1.ServicePort{
+		{Name: "https", Port: 443, NodePort: 30443, Protocol: v1.ProtocolTCP},
+		{Name: "alt", Port: 8080, NodePort: 30081, Protocol: v1.ProtocolTCP},
+	}
+	if err := lb.UpdateLoadBalancer(context.Background(), "kubernetes", updated, nodes); err != nil {
+		t.Fatalf("UpdateLoadBalancer() error = %v", err)
+	}
+	if _, ok := f.get("10.0.0.1", vip, 80, "tcp"); ok {
+		t.Errorf("rule for the removed port 80 still exists")
+	}
+	if got := f.endpoints("10.0.0.1", vip, 8080, "tcp"); !reflect.DeepEqual(got, []string{"10.0.0.2:30081"}) {
+		t.Errorf("endpoints for added port 8080 = %v", got)
+	}
+	entry := findTestService(t, lb, svc)
+	if len(entry.Ports) != 2 || len(entry.Rules) != 2 {
+		t.Errorf("recorded service = %+v, want 2 ports and 2 rules", entry)
+	}
+
+	if err := lb.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", updated); err != nil {
+		t.Fatalf("EnsureLoadBalancerDeleted() error = %v", err)
+	}
+	if f.count("10.0.0.1") != 0 {
+		t.Errorf("rules left after delete")
+	}
+}
+
+func TestEnsureLoadBalancer_mixedProtocols(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	svc := testService("sip",
+		v1.ServicePort{Name: "dns-tcp", Port: 53, NodePort: 30053, Protocol: v1.ProtocolTCP},
+		v1.ServicePort{Name: "dns-udp", Port: 53, NodePort: 30054, Protocol: v1.ProtocolUDP},
+		v1.ServicePort{Name: "sigtran", Port: 2905, NodePort: 32905, Protocol: v1.ProtocolSCTP},
+	)
+	lb, _ := newTestLoadBalancers(f, svc)
+	nodes := []*v1.Node{
+		testNode("lb-1", "10.0.0.1", true),
+		testNode("worker-1", "10.0.0.2", false),
+	}
+
+	status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	vip := status.Ingress[0].IP
+
+	want := []struct {
+		port     int32
+		protocol string
+		endpoint string
+	}{
+		{53, "tcp", "10.0.0.2:30053"},
+		{53, "udp", "10.0.0.2:30054"},
+		{2905, "sctp", "10.0.0.2:32905"},
+	}
+	for _, w := range want {
+		rule, ok := f.get("10.0.0.1", vip, w.port, w.protocol)
+		if !ok {
+			t.Errorf("no rule programmed for [%d/%s]", w.port, w.protocol)
+			continue
+		}
+		if rule.ServiceArguments.Protocol != w.protocol {
+			t.Errorf("rule protocol = %s, want %s", rule.ServiceArguments.Protocol, w.protocol)
+		}
+		if got := f.endpoints("10.0.0.1", vip, w.port, w.protocol); !reflect.DeepEqual(got, []string{w.endpoint}) {
+			t.Errorf("endpoints for [%d/%s] = %v, want %s", w.port, w.protocol, got, w.endpoint)
+		}
+	}
+}
+
+func TestEnsureLoadBalancer_rejectsUnsupportedPorts(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports []v1.ServicePort
+	}{
+		{
+			name: "unsupported protocol",
+			ports: []v1.ServicePort{
+				{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP},
+				{Port: 80, NodePort: 30081, Protocol: v1.Protocol("ICMP")},
+			},
+		},
+		{
+			name: "duplicate port and protocol",
+			ports: []v1.ServicePort{
+				{Port: 53, NodePort: 30053, Protocol: v1.ProtocolUDP},
+				{Port: 53, NodePort: 30054, Protocol: v1.ProtocolUDP},
+			},
+		},
+		{
+			name: "no nodePort",
+			ports: []v1.ServicePort{
+				{Port: 80, Protocol: v1.ProtocolTCP},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeLoxiLB()
+			defer f.Close()
+
+			svc := testService("invalid", tt.ports...)
+			lb, _ := newTestLoadBalancers(f, svc)
+			nodes := []*v1.Node{
+				testNode("lb-1", "10.0.0.1", true),
+				testNode("worker-1", "10.0.0.2", false),
+			}
+
+			if _, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes); err == nil {
+				t.Fatalf("EnsureLoadBalancer() expected an error")
+			}
+			if f.count("10.0.0.1") != 0 {
+				t.Errorf("rules were programmed for an invalid service")
+			}
+			select {
+			case event := <-lb.recorder.(*record.FakeRecorder).Events:
+				if !strings.HasPrefix(event, "Warning UnsupportedPorts") {
+					t.Errorf("event = %s, want an UnsupportedPorts warning", event)
+				}
+			default:
+				t.Errorf("no event was recorded on the service")
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancer_dualStack(t *testing.T) {
+	ipv6 := v1.IPv6Protocol
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		ipFamily    *v1.IPFamily
+		wantVips    []string
+	}{
+		{
+			name:     "ipv4 by default",
+			wantVips: []string{"192.168.0.1"},
+		},
+		{
+			name:     "ipv6 service",
+			ipFamily: &ipv6,
+			wantVips: []string{"fd00::1"},
+		},
+		{
+			name:        "dual stack, ipv6 primary",
+			annotations: map[string]string{ipFamiliesAnnotation: "IPv6,IPv4"},
+			wantVips:    []string{"fd00::1", "192.168.0.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeLoxiLB()
+			defer f.Close()
+
+			svc := testService("dual", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+			svc.Annotations = tt.annotations
+			svc.Spec.IPFamily = tt.ipFamily
+			lb, kubeClient := newTestLoadBalancers(f, svc)
+			controllerCM, _ := kubeClient.CoreV1().ConfigMaps("kube-system").Get(context.Background(), NetloxCloudConfig, metav1.GetOptions{})
+			controllerCM.Data["cidr-global"] = "192.168.0.0/24,fd00::/120"
+			kubeClient.CoreV1().ConfigMaps("kube-system").Update(context.Background(), controllerCM, metav1.UpdateOptions{})
+
+			lbNode := testNode("lb-1", "10.0.0.1", true)
+			worker := testNode("worker-1", "10.0.0.2", false)
+			worker.Status.Addresses = append(worker.Status.Addresses, v1.NodeAddress{Type: v1.NodeInternalIP, Address: "fd00:1::2"})
+			nodes := []*v1.Node{lbNode, worker}
+
+			status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+			if err != nil {
+				t.Fatalf("EnsureLoadBalancer() error = %v", err)
+			}
+			var vips []string
+			for _, ingress := range status.Ingress {
+				vips = append(vips, ingress.IP)
+			}
+			if !reflect.DeepEqual(vips, tt.wantVips) {
+				t.Fatalf("EnsureLoadBalancer() ingress = %v, want %v", vips, tt.wantVips)
+			}
+
+			// Every VIP is programmed, forwarding to the node addresses of its family
+			for _, vip := range tt.wantVips {
+				want := []string{"10.0.0.2:30080"}
+				if strings.Contains(vip, ":") {
+					want = []string{"[fd00:1::2]:30080"}
+				}
+				if got := f.endpoints("10.0.0.1", vip, 80, "tcp"); !reflect.DeepEqual(got, want) {
+					t.Errorf("LoxiLB rule for [%s] endpoints = %v, want %v", vip, got, want)
+				}
+			}
+
+			svc.Status.LoadBalancer = *status
+			if err := lb.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc); err != nil {
+				t.Fatalf("EnsureLoadBalancerDeleted() error = %v", err)
+			}
+			if n := f.count("10.0.0.1"); n != 0 {
+				t.Errorf("LoxiLB still has %d rules after delete", n)
+			}
+			for _, vip := range tt.wantVips {
+				if lb.allocator.IsAllocated(vip) {
+					t.Errorf("address [%s] is still allocated after delete", vip)
+				}
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancer_dualStackRecordFailure(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	svc := testService("dual", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	svc.Annotations = map[string]string{ipFamiliesAnnotation: "IPv4,IPv6"}
+	lb, kubeClient := newTestLoadBalancers(f, svc)
+	controllerCM, _ := kubeClient.CoreV1().ConfigMaps("kube-system").Get(context.Background(), NetloxCloudConfig, metav1.GetOptions{})
+	controllerCM.Data["cidr-global"] = "192.168.0.0/24,fd00::/120"
+	kubeClient.CoreV1().ConfigMaps("kube-system").Update(context.Background(), controllerCM, metav1.UpdateOptions{})
+	nodes := []*v1.Node{
+		testNode("lb-1", "10.0.0.1", true),
+		testNode("worker-1", "10.0.0.2", false),
+	}
+	wantVips := []string{"192.168.0.1", "fd00::1"}
+
+	// The service can't be recorded, every address is released and nothing is left programmed
+	kubeClient.PrependReactor("*", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() != svc.Namespace || (action.GetVerb() != "create" && action.GetVerb() != "update") {
+			return false, nil, nil
+		}
+		return true, nil, fmt.Errorf("fake update failure")
+	})
+	if _, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes); err == nil {
+		t.Fatalf("EnsureLoadBalancer() expected an error")
+	}
+	for _, vip := range wantVips {
+		if lb.allocator.IsAllocated(vip) {
+			t.Errorf("address [%s] is still allocated", vip)
+		}
+	}
+	if n := f.count("10.0.0.1"); n != 0 {
+		t.Errorf("LoxiLB still has %d rules", n)
+	}
+
+	// The retry allocates both addresses again and records them
+	kubeClient.ReactionChain = kubeClient.ReactionChain[1:]
+	status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	var vips []string
+	for _, ingress := range status.Ingress {
+		vips = append(vips, ingress.IP)
+	}
+	if !reflect.DeepEqual(vips, wantVips) {
+		t.Errorf("EnsureLoadBalancer() ingress = %v, want %v", vips, wantVips)
+	}
+	if entry := findTestService(t, lb, svc); entry == nil || !reflect.DeepEqual(entry.Vips, wantVips) {
+		t.Errorf("recorded service = %+v, want vips %v", entry, wantVips)
+	}
+}
+
+func TestEnsureLoadBalancer_unknownIPFamily(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	svc := testService("dual", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	svc.Annotations = map[string]string{ipFamiliesAnnotation: "IPv4,IPv5"}
+	lb, _ := newTestLoadBalancers(f, svc)
+
+	if _, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nil); err == nil {
+		t.Fatalf("EnsureLoadBalancer() expected an error")
+	}
+	if event := <-lb.recorder.(*record.FakeRecorder).Events; !strings.Contains(event, "UnsupportedIPFamilies") {
+		t.Errorf("event = %s, want UnsupportedIPFamilies", event)
+	}
+}
+
+func TestDiscoverPool(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     map[string]string
+		poolName string
+		want     *ipam.Pool
+	}{
+		{
+			name: "namespace cidr before global",
+			data: map[string]string{"cidr-default": "10.0.0.0/24", "cidr-global": "10.0.1.0/24"},
+			want: &ipam.Pool{Name: "cidr-default", CIDR: "10.0.0.0/24"},
+		},
+		{
+			name: "global cidr before namespace range",
+			data: map[string]string{"cidr-global": "10.0.1.0/24", "range-default": "10.0.2.1-10.0.2.9"},
+			want: &ipam.Pool{Name: "cidr-global", CIDR: "10.0.1.0/24"},
+		},
+		{
+			name: "strategy of the pool",
+			data: map[string]string{"range-global": "10.0.2.1-10.0.2.9", "strategy-range-global": "round-robin", "strategy-cidr-global": "random"},
+			want: &ipam.Pool{Name: "range-global", Range: "10.0.2.1-10.0.2.9", Strategy: ipam.RoundRobin},
+		},
+		{
+			name: "exclusions of the pool namespace",
+			data: map[string]string{"cidr-default": "10.0.0.0/24", "exclude-default": "10.0.0.1", "exclude-global": "10.0.1.1"},
+			want: &ipam.Pool{Name: "cidr-default", CIDR: "10.0.0.0/24", Exclude: "10.0.0.1"},
+		},
+		{
+			name: "global exclusions",
+			data: map[string]string{"range-global": "10.0.2.1-10.0.2.9", "exclude-default": "10.0.0.1", "exclude-global": "10.0.2.1"},
+			want: &ipam.Pool{Name: "range-global", Range: "10.0.2.1-10.0.2.9", Exclude: "10.0.2.1"},
+		},
+		{
+			name:     "named pool",
+			data:     map[string]string{"cidr-default": "10.0.0.0/24", "pool-public": "10.1.0.0/24, 10.2.0.1-10.2.0.9", "exclude-pool-public": "10.1.0.1", "exclude-default": "10.0.0.1"},
+			poolName: "public",
+			want:     &ipam.Pool{Name: "pool-public", CIDR: "10.1.0.0/24", Range: "10.2.0.1-10.2.0.9", Exclude: "10.1.0.1"},
+		},
+		{
+			name:     "unknown named pool",
+			data:     map[string]string{"cidr-default": "10.0.0.0/24"},
+			poolName: "public",
+		},
+		{
+			name: "no pool",
+			data: map[string]string{"strategy-cidr-global": "random"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := discoverPool(&v1.ConfigMap{Data: tt.data}, "default", tt.poolName, NetloxCloudConfig)
+			if (err != nil) != (tt.want == nil) {
+				t.Fatalf("discoverPool() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("discoverPool() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnsureLoadBalancer_namedPool(t *testing.T) {
+	tests := []struct {
+		name       string
+		pool       string
+		wantVip    string
+		wantReason string
+	}{
+		{
+			name:    "namespace pool",
+			wantVip: "192.168.0.1",
+		},
+		{
+			name:    "named pool",
+			pool:    "public",
+			wantVip: "203.0.113.10",
+		},
+		{
+			name:       "unknown pool",
+			pool:       "internal",
+			wantReason: "UnknownPool",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeLoxiLB()
+			defer f.Close()
+
+			svc := testService("web", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+			if tt.pool != "" {
+				svc.Annotations = map[string]string{poolAnnotation: tt.pool}
+			}
+			lb, kubeClient := newTestLoadBalancers(f, svc)
+			controllerCM, _ := kubeClient.CoreV1().ConfigMaps("kube-system").Get(context.Background(), NetloxCloudConfig, metav1.GetOptions{})
+			controllerCM.Data["pool-public"] = "203.0.113.10-203.0.113.20"
+			kubeClient.CoreV1().ConfigMaps("kube-system").Update(context.Background(), controllerCM, metav1.UpdateOptions{})
+
+			status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nil)
+			if tt.wantReason != "" {
+				if err == nil {
+					t.Fatalf("EnsureLoadBalancer() expected an error")
+				}
+				if event := <-lb.recorder.(*record.FakeRecorder).Events; !strings.Contains(event, tt.wantReason) {
+					t.Errorf("event = %s, want %s", event, tt.wantReason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("EnsureLoadBalancer() error = %v", err)
+			}
+			if vip := status.Ingress[0].IP; vip != tt.wantVip {
+				t.Errorf("EnsureLoadBalancer() vip = %s, want %s", vip, tt.wantVip)
+			}
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package netlox
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog"
+	"netlox.io/netlox/pkg/apis/netlox/v1alpha1"
+)
+
+// loxiLoadBalancerFinalizer keeps a LoxiLoadBalancer until the rules it records are removed from LoxiLB.
+// The service owns its LoxiLoadBalancer, so a foreground (cascading) delete of the service would otherwise
+// remove the record before EnsureLoadBalancerDeleted reads it, leaking the rules and the VIP.
+const loxiLoadBalancerFinalizer = "netlox.io/loxilb-rules"
+
+// loxiLoadBalancers records every service in a LoxiLoadBalancer named after the service and owned by it.
+// Services recorded in the netlox configMaps (the legacy store) are read from there until they are next
+// saved, which moves them to a LoxiLoadBalancer.
+type loxiLoadBalancers struct {
+	client dynamic.Interface
+	legacy serviceStore
+	// release removes the rules and releases the VIPs of a LoxiLoadBalancer left by an earlier service of
+	// the same name, svc.Rules is left with the rules that couldn't be removed. Without it such a
+	// LoxiLoadBalancer isn't replaced.
+	release func(ctx context.Context, svc *services) error
+}
+
+var _ serviceStore = &loxiLoadBalancers{}
+
+func newLoxiLoadBalancers(client dynamic.Interface, legacy serviceStore, release func(ctx context.Context, svc *services) error) *loxiLoadBalancers {
+	return &loxiLoadBalancers{
+		client:  client,
+		legacy:  legacy,
+		release: release,
+	}
+}
+
+// fetch returns the LoxiLoadBalancer named after the service, nil if there is none
+func (s *loxiLoadBalancers) fetch(ctx context.Context, service *v1.Service) (*v1alpha1.LoxiLoadBalancer, error) {
+	u, err := s.client.Resource(v1alpha1.LoxiLoadBalancerResource).Namespace(service.Namespace).Get(ctx, service.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve LoxiLoadBalancer [%s/%s] : %v", service.Namespace, service.Name, err)
+	}
+	return toLoxiLoadBalancer(u)
+}
+
+func (s *loxiLoadBalancers) get(ctx context.Context, service *v1.Service) (*services, error) {
+	current, err := s.fetch(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+	// A LoxiLoadBalancer of another UID belongs to an earlier service of the same name
+	if current != nil && current.Spec.ServiceUID == service.UID {
+		svc := recordedService(current)
+		if svc.deleting && !hasFinalizer(current) {
+			// Its rules are already removed and its VIPs released, only the record is left to collect
+			svc.Vip, svc.Vips, svc.Rules = "", nil, nil
+		}
+		return svc, nil
+	}
+	return s.legacy.get(ctx, service)
+}
+
+func (s *loxiLoadBalancers) save(ctx context.Context, service *v1.Service, svc *services, syncErr error) error {
+	current, err := s.fetch(ctx, service)
+	if err != nil {
+		return err
+	}
+	resource := s.client.Resource(v1alpha1.LoxiLoadBalancerResource).Namespace(service.Namespace)
+
+	// A LoxiLoadBalancer being deleted is never written, it is recreated once it is gone
+	if current != nil && current.DeletionTimestamp != nil {
+		return fmt.Errorf("LoxiLoadBalancer [%s/%s] is being deleted", service.Namespace, service.Name)
+	}
+	if current != nil && current.Spec.ServiceUID != service.UID {
+		if err := s.replace(ctx, current, svc); err != nil {
+			return err
+		}
+		current = nil
+	}
+
+	var desired *v1alpha1.LoxiLoadBalancer
+	if current == nil {
+		desired = &v1alpha1.LoxiLoadBalancer{
+			TypeMeta: metav1.TypeMeta{APIVersion: v1alpha1.SchemeGroupVersion.String(), Kind: "LoxiLoadBalancer"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      service.Name,
+				Namespace: service.Namespace,
+			},
+		}
+	} else {
+		desired = current.DeepCopy()
+	}
+	desired.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(service, v1.SchemeGroupVersion.WithKind("Service"))}
+	if !hasFinalizer(desired) {
+		desired.Finalizers = append(desired.Finalizers, loxiLoadBalancerFinalizer)
+	}
+	desired.Spec = loxiLoadBalancerSpec(svc)
+
+	if current == nil {
+		u, err := toUnstructured(desired)
+		if err != nil {
+			return err
+		}
+		u, err = resource.Create(ctx, u, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("Unable to create LoxiLoadBalancer [%s/%s] : %v", service.Namespace, service.Name, err)
+		}
+		if current, err = toLoxiLoadBalancer(u); err != nil {
+			return err
+		}
+		s.adopt(ctx, service)
+	} else if !reflect.DeepEqual(current.OwnerReferences, desired.OwnerReferences) || !reflect.DeepEqual(current.Finalizers, desired.Finalizers) ||
+		!reflect.DeepEqual(current.Spec, desired.Spec) {
+		u, err := toUnstructured(desired)
+		if err != nil {
+			return err
+		}
+		u, err = resource.Update(ctx, u, metav1.UpdateOptions{})
+		if err != nil {
+			return fmt.Errorf("Unable to update LoxiLoadBalancer [%s/%s] : %v", service.Namespace, service.Name, err)
+		}
+		if current, err = toLoxiLoadBalancer(u); err != nil {
+			return err
+		}
+	}
+
+	desired = current.DeepCopy()
+	desired.Status = loxiLoadBalancerStatus(svc, syncErr, current.Status.Conditions)
+	if reflect.DeepEqual(current.Status, desired.Status) {
+		return nil
+	}
+	u, err := toUnstructured(desired)
+	if err != nil {
+		return err
+	}
+	_, err = resource.UpdateStatus(ctx, u, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("Unable to update the status of LoxiLoadBalancer [%s/%s] : %v", service.Namespace, service.Name, err)
+	}
+	return nil
+}
+
+// adopt removes the service from the legacy store once it is recorded in its LoxiLoadBalancer, a failure is
+// only logged as the LoxiLoadBalancer takes precedence
+func (s *loxiLoadBalancers) adopt(ctx context.Context, service *v1.Service) {
+	legacy, err := s.legacy.get(ctx, service)
+	if err != nil || legacy == nil {
+		return
+	}
+	if err := s.legacy.delete(ctx, service); err != nil {
+		klog.Errorf("Unable to remove service [%s/%s] from configMap [%s] : %v", service.Namespace, service.Name, NetloxClientConfig, err)
+		return
+	}
+	klog.Infof("Service [%s/%s] moved from configMap [%s] to its LoxiLoadBalancer", service.Namespace, service.Name, NetloxClientConfig)
+}
+
+// replace removes the LoxiLoadBalancer of an earlier service of the same name, once its rules are removed
+// from LoxiLB and its VIPs released. The rules and VIPs svc still uses are kept.
+func (s *loxiLoadBalancers) replace(ctx context.Context, current *v1alpha1.LoxiLoadBalancer, svc *services) error {
+	stale := recordedService(current)
+	if hasFinalizer(current) {
+		if s.release == nil {
+			return fmt.Errorf("LoxiLoadBalancer [%s/%s] records service UID [%s], its rules can't be removed", current.Namespace, current.Name, current.Spec.ServiceUID)
+		}
+		keep := map[string]bool{}
+		for _, rule := range svc.Rules {
+			keep[rule.key()] = true
+		}
+		for _, vip := range svc.vips() {
+			keep[vip] = true
+		}
+		var rules []loxiRule
+		for _, rule := range stale.Rules {
+			if !keep[rule.key()] {
+				rules = append(rules, rule)
+			}
+		}
+		var vips []string
+		for _, vip := range stale.vips() {
+			if !keep[vip] {
+				vips = append(vips, vip)
+			}
+		}
+		stale.Rules, stale.Vip, stale.Vips = rules, "", vips
+		if err := s.release(ctx, stale); err != nil {
+			return fmt.Errorf("Unable to remove the rules of LoxiLoadBalancer [%s/%s] (service UID [%s]) : %v", current.Namespace, current.Name, current.Spec.ServiceUID, err)
+		}
+		klog.Infof("Removed the rules of LoxiLoadBalancer [%s/%s] left by service UID [%s]", current.Namespace, current.Name, current.Spec.ServiceUID)
+	}
+	return s.remove(ctx, current)
+}
+
+func (s *loxiLoadBalancers) delete(ctx context.Context, service *v1.Service) error {
+	current, err := s.fetch(ctx, service)
+	if err != nil {
+		return err
+	}
+	if current != nil && current.Spec.ServiceUID == service.UID {
+		if err := s.remove(ctx, current); err != nil {
+			return err
+		}
+	}
+	return s.legacy.delete(ctx, service)
+}
+
+// remove releases the finalizer of a LoxiLoadBalancer whose rules are removed and deletes it, unless it
+// is already being deleted (it is then collected once released)
+func (s *loxiLoadBalancers) remove(ctx context.Context, current *v1alpha1.LoxiLoadBalancer) error {
+	resource := s.client.Resource(v1alpha1.LoxiLoadBalancerResource).Namespace(current.Namespace)
+	if hasFinalizer(current) {
+		released := current.DeepCopy()
+		released.Finalizers = nil
+		for _, finalizer := range current.Finalizers {
+			if finalizer != loxiLoadBalancerFinalizer {
+				released.Finalizers = append(released.Finalizers, finalizer)
+			}
+		}
+		u, err := toUnstructured(released)
+		if err != nil {
+			return err
+		}
+		_, err = resource.Update(ctx, u, metav1.UpdateOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("Unable to remove the finalizer of LoxiLoadBalancer [%s/%s] : %v", current.Namespace, current.Name, err)
+		}
+	}
+	if current.DeletionTimestamp == nil {
+		err := resource.Delete(ctx, current.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &current.UID},
+		})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("Unable to delete LoxiLoadBalancer [%s/%s] : %v", current.Namespace, current.Name, err)
+		}
+	}
+	return nil
+}
+
+// hasFinalizer returns true if the LoxiLoadBalancer is kept until its rules are removed
+func hasFinalizer(lb *v1alpha1.LoxiLoadBalancer) bool {
+	for _, finalizer := range lb.Finalizers {
+		if finalizer == loxiLoadBalancerFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *loxiLoadBalancers) list(ctx context.Context) ([]services, error) {
+	items, err := s.client.Resource(v1alpha1.LoxiLoadBalancerResource).Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list LoxiLoadBalancers : %v", err)
+	}
+	var all []services
+	for x := range items.Items {
+		lb, err := toLoxiLoadBalancer(&items.Items[x])
+		if err != nil {
+			klog.Errorf("Unable to read LoxiLoadBalancer : %v", err)
+			continue
+		}
+		svc := recordedService(lb)
+		svc.Namespace = lb.Namespace
+		all = append(all, *svc)
+	}
+	legacy, err := s.legacy.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(all, legacy...), nil
+}
+
+// loxiLoadBalancerSpec returns the spec recording the service
+func loxiLoadBalancerSpec(svc *services) v1alpha1.LoxiLoadBalancerSpec {
+	spec := v1alpha1.LoxiLoadBalancerSpec{
+		ServiceUID: types.UID(svc.UID),
+		Pool:       svc.Pool,
+	}
+	for _, port := range svc.Ports {
+		spec.Ports = append(spec.Ports, v1alpha1.LoxiLoadBalancerPort{
+			Port:     int32(port.Port),
+			NodePort: int32(port.NodePort),
+			Protocol: v1.Protocol(port.Protocol),
+		})
+	}
+	return spec
+}
+
+// loxiLoadBalancerStatus returns the status recording the VIPs and rules of the service, the Programmed
+// condition keeps its transition time from the current conditions unless its status changes
+func loxiLoadBalancerStatus(svc *services, syncErr error, conditions []v1alpha1.LoxiLoadBalancerCondition) v1alpha1.LoxiLoadBalancerStatus {
+	status := v1alpha1.LoxiLoadBalancerStatus{
+		VIPs: svc.vips(),
+	}
+	nodes := map[string]bool{}
+	for _, rule := range svc.Rules {
+		status.Rules = append(status.Rules, v1alpha1.LoxiLoadBalancerRule{
+			ID:        rule.key(),
+			LoxiLB:    rule.LoxiLB,
+			Node:      rule.Node,
+			VIP:       rule.Vip,
+			Port:      int32(rule.Port),
+			Protocol:  v1.Protocol(rule.Protocol),
+			Endpoints: rule.Endpoints,
+		})
+		node := rule.Node
+		if node == "" {
+			node = rule.LoxiLB
+		}
+		if !nodes[node] {
+			nodes[node] = true
+			status.Nodes = append(status.Nodes, node)
+		}
+	}
+	sort.Strings(status.Nodes)
+
+	programmed := v1alpha1.LoxiLoadBalancerCondition{
+		Type:   v1alpha1.LoxiLoadBalancerProgrammed,
+		Status: v1.ConditionTrue,
+		Reason: "Programmed",
+	}
+	switch {
+	case syncErr != nil:
+		programmed.Status = v1.ConditionFalse
+		programmed.Reason = "ProgrammingFailed"
+		programmed.Message = syncErr.Error()
+	case len(status.Nodes) == 0:
+		programmed.Status = v1.ConditionFalse
+		programmed.Reason = "NoLoadBalancerNodes"
+		programmed.Message = fmt.Sprintf("No nodes are labelled [%s=%s]", loadBalancerLabel, loadBalancerLabelValue)
+	default:
+		programmed.Message = fmt.Sprintf("Programmed on [%d] LoxiLB nodes", len(status.Nodes))
+	}
+	programmed.LastTransitionTime = metav1.Now()
+	for _, condition := range conditions {
+		if condition.Type == programmed.Type && condition.Status == programmed.Status {
+			programmed.LastTransitionTime = condition.LastTransitionTime
+		}
+	}
+	status.Conditions = []v1alpha1.LoxiLoadBalancerCondition{programmed}
+	return status
+}
+
+// recordedService returns the service recorded by a LoxiLoadBalancer
+func recordedService(lb *v1alpha1.LoxiLoadBalancer) *services {
+	svc := &services{
+		Vips:        lb.Status.VIPs,
+		Pool:        lb.Spec.Pool,
+		UID:         string(lb.Spec.ServiceUID),
+		ServiceName: lb.Name,
+		deleting:    lb.DeletionTimestamp != nil,
+	}
+	if len(svc.Vips) != 0 {
+		svc.Vip = svc.Vips[0]
+	}
+	for _, port := range lb.Spec.Ports {
+		svc.Ports = append(svc.Ports, portMapping{
+			Port:     int(port.Port),
+			NodePort: int(port.NodePort),
+			Protocol: string(port.Protocol),
+		})
+	}
+	for _, rule := range lb.Status.Rules {
+		svc.Rules = append(svc.Rules, loxiRule{
+			LoxiLB:    rule.LoxiLB,
+			Node:      rule.Node,
+			Vip:       rule.VIP,
+			Port:      int(rule.Port),
+			Protocol:  string(rule.Protocol),
+			Endpoints: rule.Endpoints,
+		})
+	}
+	return svc
+}
+
+// toLoxiLoadBalancer converts an unstructured object to a LoxiLoadBalancer
+func toLoxiLoadBalancer(u *unstructured.Unstructured) (*v1alpha1.LoxiLoadBalancer, error) {
+	lb := &v1alpha1.LoxiLoadBalancer{}
+	err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), lb)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to convert LoxiLoadBalancer [%s/%s] : %v", u.GetNamespace(), u.GetName(), err)
+	}
+	return lb, nil
+}
+
+// toUnstructured converts a LoxiLoadBalancer to an unstructured object
+func toUnstructured(lb *v1alpha1.LoxiLoadBalancer) (*unstructured.Unstructured, error) {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(lb)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to convert LoxiLoadBalancer [%s/%s] : %v", lb.Namespace, lb.Name, err)
+	}
+	return &unstructured.Unstructured{Object: content}, nil
+}
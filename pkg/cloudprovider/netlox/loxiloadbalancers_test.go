@@ -0,0 +1,310 @@
+package netlox
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"netlox.io/netlox/pkg/apis/netlox/v1alpha1"
+)
+
+// useTestLoxiLoadBalancers records the services of the load balancers in LoxiLoadBalancers
+func useTestLoxiLoadBalancers(lb *loadbalancers) *dynamicfake.FakeDynamicClient {
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	lb.store = newLoxiLoadBalancers(client, lb.store, lb.releaseRecord)
+	return client
+}
+
+func getTestLoxiLoadBalancer(t *testing.T, client *dynamicfake.FakeDynamicClient, service *v1.Service) *v1alpha1.LoxiLoadBalancer {
+	u, err := client.Resource(v1alpha1.LoxiLoadBalancerResource).Namespace(service.Namespace).Get(context.Background(), service.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := toLoxiLoadBalancer(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lb
+}
+
+func TestEnsureLoadBalancer_loxiLoadBalancer(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	svc := testService("nginx", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	lb, _ := newTestLoadBalancers(f, svc)
+	client := useTestLoxiLoadBalancers(lb)
+	nodes := []*v1.Node{
+		testNode("lb-1", "10.0.0.1", true),
+		testNode("worker-1", "10.0.0.2", false),
+	}
+
+	status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	vip := status.Ingress[0].IP
+
+	got := getTestLoxiLoadBalancer(t, client, svc)
+	if got == nil {
+		t.Fatalf("no LoxiLoadBalancer was created")
+	}
+	if len(got.OwnerReferences) != 1 || got.OwnerReferences[0].UID != svc.UID || got.OwnerReferences[0].Kind != "Service" {
+		t.Errorf("LoxiLoadBalancer owners = %+v, want the service", got.OwnerReferences)
+	}
+	if !reflect.DeepEqual(got.Finalizers, []string{loxiLoadBalancerFinalizer}) {
+		t.Errorf("LoxiLoadBalancer finalizers = %v, want %s", got.Finalizers, loxiLoadBalancerFinalizer)
+	}
+	wantSpec := v1alpha1.LoxiLoadBalancerSpec{
+		ServiceUID: svc.UID,
+		Ports:      []v1alpha1.LoxiLoadBalancerPort{{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP}},
+	}
+	if !reflect.DeepEqual(got.Spec, wantSpec) {
+		t.Errorf("LoxiLoadBalancer spec = %+v, want %+v", got.Spec, wantSpec)
+	}
+	wantRules := []v1alpha1.LoxiLoadBalancerRule{{
+		ID:        "10.0.0.1/" + vip + "/80/TCP",
+		LoxiLB:    "10.0.0.1",
+		Node:      "lb-1",
+		VIP:       vip,
+		Port:      80,
+		Protocol:  v1.ProtocolTCP,
+		Endpoints: []string{"10.0.0.2:30080"},
+	}}
+	if !reflect.DeepEqual(got.Status.VIPs, []string{vip}) || !reflect.DeepEqual(got.Status.Nodes, []string{"lb-1"}) || !reflect.DeepEqual(got.Status.Rules, wantRules) {
+		t.Errorf("LoxiLoadBalancer status = %+v, want vip %s programmed on lb-1", got.Status, vip)
+	}
+	if c := got.Status.Conditions; len(c) != 1 || c[0].Type != v1alpha1.LoxiLoadBalancerProgrammed || c[0].Status != v1.ConditionTrue {
+		t.Errorf("LoxiLoadBalancer conditions = %+v, want Programmed", c)
+	}
+	if entry := findTestService(t, lb, svc); entry != nil {
+		t.Errorf("service is recorded in the configMap: %+v", entry)
+	}
+
+	// A LoxiLB that can't be programmed is reported by the condition
+	f.setFailing("10.0.0.1", true)
+	nodes = append(nodes, testNode("worker-2", "10.0.0.3", false))
+	if err := lb.UpdateLoadBalancer(context.Background(), "kubernetes", svc, nodes); err == nil {
+		t.Fatalf("UpdateLoadBalancer() expected an error for lb-1")
+	}
+	got = getTestLoxiLoadBalancer(t, client, svc)
+	if c := got.Status.Conditions; len(c) != 1 || c[0].Status != v1.ConditionFalse || c[0].Reason != "ProgrammingFailed" {
+		t.Errorf("LoxiLoadBalancer conditions = %+v, want ProgrammingFailed", c)
+	}
+	if !reflect.DeepEqual(got.Status.Rules, wantRules) {
+		t.Errorf("LoxiLoadBalancer rules = %+v, want the rule that is still programmed %+v", got.Status.Rules, wantRules)
+	}
+
+	f.setFailing("10.0.0.1", false)
+	svc.Status.LoadBalancer = *status
+	if err := lb.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc); err != nil {
+		t.Fatalf("EnsureLoadBalancerDeleted() error = %v", err)
+	}
+	if got = getTestLoxiLoadBalancer(t, client, svc); got != nil {
+		t.Errorf("LoxiLoadBalancer wasn't deleted: %+v", got)
+	}
+	if lb.allocator.IsAllocated(vip) {
+		t.Errorf("vip %s wasn't released", vip)
+	}
+}
+
+func TestEnsureLoadBalancerDeleted_foregroundDeletion(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	svc := testService("nginx", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	lb, _ := newTestLoadBalancers(f, svc)
+	client := useTestLoxiLoadBalancers(lb)
+	nodes := []*v1.Node{
+		testNode("lb-1", "10.0.0.1", true),
+		testNode("worker-1", "10.0.0.2", false),
+	}
+	status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	svc.Status.LoadBalancer = *status
+
+	// The garbage collector deletes the dependents of the service first, its finalizer keeps the
+	// LoxiLoadBalancer (and so the rules to remove) until the load balancer is deleted
+	got := getTestLoxiLoadBalancer(t, client, svc)
+	now := metav1.Now()
+	got.DeletionTimestamp = &now
+	u, err := toUnstructured(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Resource(v1alpha1.LoxiLoadBalancerResource).Namespace(svc.Namespace).Update(context.Background(), u, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lb.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", svc); err != nil {
+		t.Fatalf("EnsureLoadBalancerDeleted() error = %v", err)
+	}
+	if n := f.count("10.0.0.1"); n != 0 {
+		t.Errorf("lb-1 has %d rules left, want none", n)
+	}
+	if lb.allocator.IsAllocated(status.Ingress[0].IP) {
+		t.Errorf("vip %s wasn't released", status.Ingress[0].IP)
+	}
+	if got = getTestLoxiLoadBalancer(t, client, svc); got != nil && len(got.Finalizers) != 0 {
+		t.Errorf("LoxiLoadBalancer finalizers = %v, want none once the rules are removed", got.Finalizers)
+	}
+}
+
+func TestLoxiLoadBalancers_adoptsConfigMapRecord(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	svc := testService("nginx", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: NetloxClientConfig, Namespace: "default"},
+		Data: map[string]string{
+			NetloxServicesKey: `{"services":[{"vip":"192.168.0.201","uid":"nginx-uid","serviceName":"nginx","ports":[{"port":80,"nodePort":30080,"protocol":"TCP"}]}]}`,
+		},
+	}
+	lb, _ := newTestLoadBalancers(f, svc, cm)
+	client := useTestLoxiLoadBalancers(lb)
+	if err := lb.rebuildAllocations(context.Background()); err != nil {
+		t.Fatalf("rebuildAllocations() error = %v", err)
+	}
+	if !lb.allocator.IsAllocated("192.168.0.201") {
+		t.Errorf("the configMap vip wasn't rebuilt")
+	}
+
+	status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, []*v1.Node{testNode("lb-1", "10.0.0.1", true)})
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	if vip := status.Ingress[0].IP; vip != "192.168.0.201" {
+		t.Errorf("EnsureLoadBalancer() vip = %s, want the recorded 192.168.0.201", vip)
+	}
+	got := getTestLoxiLoadBalancer(t, client, svc)
+	if got == nil || !reflect.DeepEqual(got.Status.VIPs, []string{"192.168.0.201"}) {
+		t.Fatalf("LoxiLoadBalancer = %+v, want the recorded vip", got)
+	}
+	if entry := findTestService(t, lb, svc); entry != nil {
+		t.Errorf("service is still recorded in the configMap: %+v", entry)
+	}
+}
+
+func TestLoxiLoadBalancers_replacesEarlierService(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	earlier := testService("nginx", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	lb, _ := newTestLoadBalancers(f, earlier)
+	client := useTestLoxiLoadBalancers(lb)
+	nodes := []*v1.Node{
+		testNode("lb-1", "10.0.0.1", true),
+		testNode("worker-1", "10.0.0.2", false),
+	}
+	status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", earlier, nodes)
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	earlierVip := status.Ingress[0].IP
+
+	// The service is recreated while the controller misses the delete of the earlier one
+	svc := testService("nginx", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	svc.UID = "nginx-uid-2"
+	status, err = lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	vip := status.Ingress[0].IP
+	if vip == earlierVip {
+		t.Fatalf("EnsureLoadBalancer() vip = %s, want a new vip", vip)
+	}
+	if _, ok := f.get("10.0.0.1", earlierVip, 80, "TCP"); ok {
+		t.Errorf("the rule of the earlier service (vip %s) wasn't removed", earlierVip)
+	}
+	if _, ok := f.get("10.0.0.1", vip, 80, "TCP"); !ok {
+		t.Errorf("vip %s wasn't programmed", vip)
+	}
+	if lb.allocator.IsAllocated(earlierVip) {
+		t.Errorf("the vip of the earlier service %s wasn't released", earlierVip)
+	}
+	got := getTestLoxiLoadBalancer(t, client, svc)
+	if got == nil || got.Spec.ServiceUID != svc.UID || !reflect.DeepEqual(got.Finalizers, []string{loxiLoadBalancerFinalizer}) {
+		t.Fatalf("LoxiLoadBalancer = %+v, want the new service with the finalizer", got)
+	}
+	if !reflect.DeepEqual(got.Status.VIPs, []string{vip}) || len(got.Status.Rules) != 1 || got.Status.Rules[0].VIP != vip {
+		t.Errorf("LoxiLoadBalancer status = %+v, want only vip %s", got.Status, vip)
+	}
+}
+
+func TestLoxiLoadBalancers_deletedWhileServiceExists(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	svc := testService("nginx", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	lb, _ := newTestLoadBalancers(f, svc)
+	client := useTestLoxiLoadBalancers(lb)
+	nodes := []*v1.Node{
+		testNode("lb-1", "10.0.0.1", true),
+		testNode("worker-1", "10.0.0.2", false),
+	}
+	status, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	svc.Status.LoadBalancer = *status
+	vip := status.Ingress[0].IP
+
+	// The LoxiLoadBalancer is deleted, another finalizer keeps it once its own is released
+	got := getTestLoxiLoadBalancer(t, client, svc)
+	now := metav1.Now()
+	got.DeletionTimestamp = &now
+	got.Finalizers = append(got.Finalizers, "example.com/keep")
+	u, err := toUnstructured(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Resource(v1alpha1.LoxiLoadBalancerResource).Namespace(svc.Namespace).Update(context.Background(), u, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes); err == nil {
+			t.Fatalf("EnsureLoadBalancer() expected an error while the LoxiLoadBalancer is being deleted")
+		}
+		if n := f.count("10.0.0.1"); n != 0 {
+			t.Errorf("lb-1 has %d rules left, want none", n)
+		}
+		if lb.allocator.IsAllocated(vip) {
+			t.Errorf("vip %s wasn't released", vip)
+		}
+		deleting := getTestLoxiLoadBalancer(t, client, svc)
+		if deleting == nil || deleting.DeletionTimestamp == nil || !reflect.DeepEqual(deleting.Finalizers, []string{"example.com/keep"}) {
+			t.Fatalf("LoxiLoadBalancer = %+v, want it still being deleted without the finalizer", deleting)
+		}
+		if !reflect.DeepEqual(deleting.Spec, got.Spec) || !reflect.DeepEqual(deleting.Status, got.Status) {
+			t.Errorf("LoxiLoadBalancer being deleted was written: %+v", deleting)
+		}
+	}
+
+	// Once it is collected the load balancer is recreated
+	if err := client.Resource(v1alpha1.LoxiLoadBalancerResource).Namespace(svc.Namespace).Delete(context.Background(), svc.Name, metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	status, err = lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes)
+	if err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	if _, ok := f.get("10.0.0.1", status.Ingress[0].IP, 80, "TCP"); !ok {
+		t.Errorf("vip %s wasn't programmed", status.Ingress[0].IP)
+	}
+	got = getTestLoxiLoadBalancer(t, client, svc)
+	if got == nil || got.DeletionTimestamp != nil || !reflect.DeepEqual(got.Finalizers, []string{loxiLoadBalancerFinalizer}) {
+		t.Errorf("LoxiLoadBalancer = %+v, want it recreated with the finalizer", got)
+	}
+}
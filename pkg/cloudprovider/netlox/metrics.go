@@ -0,0 +1,129 @@
+package netlox
+
+import (
+	"math/big"
+	"sync"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"netlox.io/netlox/pkg/ipam"
+)
+
+const (
+	metricsNamespace = "netlox"
+	metricsSubsystem = "ipam"
+)
+
+var (
+	// The capacity and free gauges are the counts of the whole pool, the allocated gauge is split by the
+	// namespace of the services the addresses are allocated to
+	poolCapacity = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Subsystem:      metricsSubsystem,
+			Name:           "pool_capacity_addresses",
+			Help:           "Number of addresses a pool can hand out",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"pool"},
+	)
+	poolAllocated = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Subsystem:      metricsSubsystem,
+			Name:           "pool_allocated_addresses",
+			Help:           "Number of addresses of a pool that are allocated to the services of a namespace",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"pool", "namespace"},
+	)
+	poolFree = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace:      metricsNamespace,
+			Subsystem:      metricsSubsystem,
+			Name:           "pool_free_addresses",
+			Help:           "Number of addresses of a pool that are free",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"pool"},
+	)
+	allocationFailures = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace:      metricsNamespace,
+			Subsystem:      metricsSubsystem,
+			Name:           "allocation_failures_total",
+			Help:           "Number of times a service couldn't be allocated an address, the pool is empty if none was found",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"pool", "namespace"},
+	)
+)
+
+var registerMetrics sync.Once
+
+// registerIPAMMetrics registers the ipam metrics with the legacy registry served by the controller manager
+func registerIPAMMetrics() {
+	registerMetrics.Do(func() {
+		legacyregistry.MustRegister(poolCapacity)
+		legacyregistry.MustRegister(poolAllocated)
+		legacyregistry.MustRegister(poolFree)
+		legacyregistry.MustRegister(allocationFailures)
+	})
+}
+
+// poolUsage tracks the pools that have been used, so that their gauges can be updated whenever an address
+// is allocated or released
+type poolUsage struct {
+	mu    sync.Mutex
+	pools map[string]ipam.Pool
+	// namespaces are the namespaces the allocated gauge of every pool is set for
+	namespaces map[string]map[string]bool
+}
+
+// seen records that addresses are handed out from the pool
+func (u *poolUsage) seen(pool ipam.Pool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.pools == nil {
+		u.pools = map[string]ipam.Pool{}
+		u.namespaces = map[string]map[string]bool{}
+	}
+	u.pools[pool.Name] = pool
+}
+
+// update sets the gauges of every pool that has been used from the allocator, the allocated gauge of a
+// namespace that no longer has addresses of the pool is removed
+func (u *poolUsage) update(allocator addressAllocator) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for name, pool := range u.pools {
+		capacity, used, err := allocator.Usage(pool)
+		if err != nil {
+			continue
+		}
+		allocated, err := allocator.Allocated(pool)
+		if err != nil {
+			continue
+		}
+		capacityValue, _ := new(big.Float).SetInt(capacity).Float64()
+		usedValue, _ := new(big.Float).SetInt(used).Float64()
+		poolCapacity.WithLabelValues(name).Set(capacityValue)
+		poolFree.WithLabelValues(name).Set(capacityValue - usedValue)
+
+		byNamespace := map[string]int{}
+		for _, owner := range allocated {
+			byNamespace[ownerNamespace(owner)]++
+		}
+		for namespace := range u.namespaces[name] {
+			if _, ok := byNamespace[namespace]; !ok {
+				poolAllocated.Delete(map[string]string{"pool": name, "namespace": namespace})
+			}
+		}
+		namespaces := map[string]bool{}
+		for namespace, count := range byNamespace {
+			poolAllocated.WithLabelValues(name, namespace).Set(float64(count))
+			namespaces[namespace] = true
+		}
+		u.namespaces[name] = namespaces
+	}
+}
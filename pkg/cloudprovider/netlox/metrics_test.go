@@ -0,0 +1,120 @@
+package netlox
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestEnsureLoadBalancer_poolMetrics(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	lb, kubeClient := newTestLoadBalancers(f)
+	controllerCM, _ := kubeClient.CoreV1().ConfigMaps("kube-system").Get(context.Background(), NetloxCloudConfig, metav1.GetOptions{})
+	controllerCM.Data["cidr-metrics"] = "192.168.1.0/30"
+	kubeClient.CoreV1().ConfigMaps("kube-system").Update(context.Background(), controllerCM, metav1.UpdateOptions{})
+
+	gauge := func(vec *metrics.GaugeVec, labels ...string) float64 {
+		value, err := testutil.GetGaugeMetricValue(vec.WithLabelValues(labels...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+
+	var services []*v1.Service
+	for _, name := range []string{"first", "second", "third"} {
+		svc := testService(name, v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+		svc.Namespace = "metrics"
+		kubeClient.CoreV1().Services(svc.Namespace).Create(context.Background(), svc, metav1.CreateOptions{})
+		services = append(services, svc)
+	}
+
+	for _, svc := range services[:2] {
+		if _, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nil); err != nil {
+			t.Fatalf("EnsureLoadBalancer() error = %v", err)
+		}
+	}
+	if capacity, allocated, free := gauge(poolCapacity, "cidr-metrics"), gauge(poolAllocated, "cidr-metrics", "metrics"), gauge(poolFree, "cidr-metrics"); capacity != 2 || allocated != 2 || free != 0 {
+		t.Errorf("pool gauges = %v/%v/%v, want 2/2/0", capacity, allocated, free)
+	}
+
+	// The pool is exhausted
+	failures, _ := testutil.GetCounterMetricValue(allocationFailures.WithLabelValues("cidr-metrics", "metrics"))
+	if _, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", services[2], nil); err == nil {
+		t.Fatalf("EnsureLoadBalancer() expected the pool to be exhausted")
+	}
+	if after, _ := testutil.GetCounterMetricValue(allocationFailures.WithLabelValues("cidr-metrics", "metrics")); after != failures+1 {
+		t.Errorf("allocation failures = %v, want %v", after, failures+1)
+	}
+	if event := <-lb.recorder.(*record.FakeRecorder).Events; !strings.Contains(event, "AllocationFailed") {
+		t.Errorf("event = %s, want AllocationFailed", event)
+	}
+
+	// Releasing an address frees it up in the gauges
+	services[0].Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "192.168.1.1"}}
+	if err := lb.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", services[0]); err != nil {
+		t.Fatalf("EnsureLoadBalancerDeleted() error = %v", err)
+	}
+	if allocated, free := gauge(poolAllocated, "cidr-metrics", "metrics"), gauge(poolFree, "cidr-metrics"); allocated != 1 || free != 1 {
+		t.Errorf("pool gauges after delete = %v/%v, want 1/1", allocated, free)
+	}
+}
+
+func TestEnsureLoadBalancer_poolMetricsByNamespace(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	lb, kubeClient := newTestLoadBalancers(f)
+	controllerCM, _ := kubeClient.CoreV1().ConfigMaps("kube-system").Get(context.Background(), NetloxCloudConfig, metav1.GetOptions{})
+	controllerCM.Data["pool-shared"] = "192.168.2.0/29"
+	kubeClient.CoreV1().ConfigMaps("kube-system").Update(context.Background(), controllerCM, metav1.UpdateOptions{})
+
+	// Two namespaces share the named pool, two services in team-a and one in team-b
+	var services []*v1.Service
+	for _, name := range []string{"team-a/first", "team-a/second", "team-b/third"} {
+		parts := strings.Split(name, "/")
+		svc := testService(parts[1], v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+		svc.Namespace = parts[0]
+		svc.Annotations = map[string]string{poolAnnotation: "shared"}
+		kubeClient.CoreV1().Services(svc.Namespace).Create(context.Background(), svc, metav1.CreateOptions{})
+		if _, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nil); err != nil {
+			t.Fatalf("EnsureLoadBalancer(%s) error = %v", name, err)
+		}
+		services = append(services, svc)
+	}
+
+	gauge := func(vec *metrics.GaugeVec, labels ...string) float64 {
+		value, err := testutil.GetGaugeMetricValue(vec.WithLabelValues(labels...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	// The namespaces add up to the pool usage
+	if a, b := gauge(poolAllocated, "pool-shared", "team-a"), gauge(poolAllocated, "pool-shared", "team-b"); a != 2 || b != 1 {
+		t.Errorf("allocated gauges = team-a %v, team-b %v, want 2 and 1", a, b)
+	}
+	if capacity, free := gauge(poolCapacity, "pool-shared"), gauge(poolFree, "pool-shared"); capacity != 6 || free != 3 {
+		t.Errorf("pool gauges = %v/%v, want 6/3", capacity, free)
+	}
+
+	// The namespace without addresses left is no longer reported
+	services[2].Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "192.168.2.3"}}
+	if err := lb.EnsureLoadBalancerDeleted(context.Background(), "kubernetes", services[2]); err != nil {
+		t.Fatalf("EnsureLoadBalancerDeleted() error = %v", err)
+	}
+	if poolAllocated.Delete(map[string]string{"pool": "pool-shared", "namespace": "team-b"}) {
+		t.Errorf("team-b still has an allocated gauge")
+	}
+	if a := gauge(poolAllocated, "pool-shared", "team-a"); a != 2 {
+		t.Errorf("team-a allocated gauge = %v, want 2", a)
+	}
+}
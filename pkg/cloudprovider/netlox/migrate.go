@@ -0,0 +1,190 @@
+package netlox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"netlox.io/netlox/pkg/apis/netlox/v1alpha1"
+	"sigs.k8s.io/yaml"
+)
+
+// MigrateOptions configures the migration of the services recorded in the netlox configMaps
+type MigrateOptions struct {
+	// ConfigMap is the name of the netlox configMap of every namespace
+	ConfigMap string
+	// DryRun prints the changes as a diff instead of making them
+	DryRun bool
+}
+
+// MigrateResult counts the recorded services by what the migration did with them
+type MigrateResult struct {
+	Migrated int
+	Skipped  int
+}
+
+// Migrate moves the services recorded in the netlox configMap of every namespace by earlier releases to
+// LoxiLoadBalancers, keeping their VIPs. A record is only moved once it is verified against its live
+// Service: the Service must still exist (with the recorded UID) as a LoadBalancer and its status must
+// have the recorded VIPs (or none yet). Records that can't be verified are reported and left in the
+// configMap. Every change is written to out, as a diff for a dry run.
+func Migrate(ctx context.Context, kubeClient kubernetes.Interface, client dynamic.Interface, opts MigrateOptions, out io.Writer) (*MigrateResult, error) {
+	if opts.ConfigMap == "" {
+		opts.ConfigMap = NetloxClientConfig
+	}
+	if !opts.DryRun && !resourceInstalled(kubeClient, v1alpha1.LoxiLoadBalancerResource) {
+		return nil, fmt.Errorf("The LoxiLoadBalancer CRD isn't installed, apply manifests/crds/loxiloadbalancer.yaml first")
+	}
+
+	lb := &loadbalancers{
+		kubeClient:     kubeClient,
+		cloudConfigMap: opts.ConfigMap,
+	}
+	legacy := &configMapStore{lb: lb}
+	target := newLoxiLoadBalancers(client, legacy, nil)
+
+	cms, err := kubeClient.CoreV1().ConfigMaps(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("metadata.name=%s", opts.ConfigMap),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list [%s] configMaps : %v", opts.ConfigMap, err)
+	}
+
+	result := &MigrateResult{}
+	for x := range cms.Items {
+		cm := &cms.Items[x]
+		if cm.Name != opts.ConfigMap {
+			continue
+		}
+		if _, ok := cm.Data[NetloxServicesKey]; !ok {
+			continue
+		}
+		svcs, err := lb.GetServices(cm)
+		if err != nil {
+			fmt.Fprintf(out, "# configMap [%s/%s] skipped, its services can't be read : %v\n", cm.Namespace, cm.Name, err)
+			continue
+		}
+		if len(svcs.Services) == 0 {
+			continue
+		}
+
+		live, err := kubeClient.CoreV1().Services(cm.Namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return result, fmt.Errorf("Unable to list services in [%s] : %v", cm.Namespace, err)
+		}
+		byUID := map[types.UID]*v1.Service{}
+		for y := range live.Items {
+			byUID[live.Items[y].UID] = &live.Items[y]
+		}
+
+		for y := range svcs.Services {
+			svc := &svcs.Services[y]
+			name := fmt.Sprintf("%s/%s", cm.Namespace, svc.ServiceName)
+			service, reason := verifyRecord(svc, byUID[types.UID(svc.UID)])
+			if reason != "" {
+				fmt.Fprintf(out, "# %s skipped, %s\n", name, reason)
+				result.Skipped++
+				continue
+			}
+
+			if opts.DryRun {
+				err = printMigrationDiff(out, cm, service, svc)
+				if err != nil {
+					return result, err
+				}
+				result.Migrated++
+				continue
+			}
+			existing, err := target.fetch(ctx, service)
+			if err != nil {
+				return result, err
+			}
+			if existing != nil && existing.Spec.ServiceUID == service.UID {
+				// Already recorded in its LoxiLoadBalancer (e.g. by a controller that synced it first),
+				// which takes precedence over the configMap record
+				err = legacy.delete(ctx, service)
+				if err != nil {
+					return result, err
+				}
+				fmt.Fprintf(out, "# %s already has a LoxiLoadBalancer, removed its configMap record\n", name)
+				result.Skipped++
+				continue
+			}
+			err = target.save(ctx, service, svc, nil)
+			if err == nil {
+				err = legacy.delete(ctx, service)
+			}
+			if err != nil {
+				return result, fmt.Errorf("Unable to migrate %s : %v", name, err)
+			}
+			fmt.Fprintf(out, "# %s migrated with vips %v\n", name, svc.vips())
+			result.Migrated++
+		}
+	}
+	return result, nil
+}
+
+// verifyRecord checks the recorded service against its live Service, returning the Service or the reason
+// the record can't be migrated
+func verifyRecord(svc *services, service *v1.Service) (*v1.Service, string) {
+	if service == nil {
+		return nil, fmt.Sprintf("no service with uid [%s] exists", svc.UID)
+	}
+	if service.Spec.Type != v1.ServiceTypeLoadBalancer {
+		return nil, fmt.Sprintf("service is of type [%s]", service.Spec.Type)
+	}
+	if len(svc.vips()) == 0 {
+		return nil, "no vip is recorded"
+	}
+	var status []string
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			status = append(status, ingress.IP)
+		}
+	}
+	if len(status) != 0 && !reflect.DeepEqual(status, svc.vips()) {
+		return nil, fmt.Sprintf("recorded vips %v don't match the service status %v", svc.vips(), status)
+	}
+	return service, ""
+}
+
+// printMigrationDiff writes the removal of the record from the configMap and the LoxiLoadBalancer that
+// replaces it
+func printMigrationDiff(out io.Writer, cm *v1.ConfigMap, service *v1.Service, svc *services) error {
+	record, err := json.MarshalIndent(svc, "", "  ")
+	if err != nil {
+		return err
+	}
+	lb := &v1alpha1.LoxiLoadBalancer{
+		TypeMeta: metav1.TypeMeta{APIVersion: v1alpha1.SchemeGroupVersion.String(), Kind: "LoxiLoadBalancer"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            service.Name,
+			Namespace:       service.Namespace,
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(service, v1.SchemeGroupVersion.WithKind("Service"))},
+		},
+		Spec:   loxiLoadBalancerSpec(svc),
+		Status: loxiLoadBalancerStatus(svc, nil, nil),
+	}
+	manifest, err := yaml.Marshal(lb)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "--- configmaps/%s/%s %s\n", cm.Namespace, cm.Name, NetloxServicesKey)
+	fmt.Fprintf(out, "+++ loxiloadbalancers/%s/%s\n", service.Namespace, service.Name)
+	for _, line := range strings.Split(string(record), "\n") {
+		fmt.Fprintf(out, "-%s\n", line)
+	}
+	for _, line := range strings.Split(strings.TrimSuffix(string(manifest), "\n"), "\n") {
+		fmt.Fprintf(out, "+%s\n", line)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package netlox
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"netlox.io/netlox/pkg/apis/netlox/v1alpha1"
+)
+
+func TestMigrate(t *testing.T) {
+	web := testService("web", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	web.Status.LoadBalancer = *loadBalancerStatus([]string{"192.168.0.201"})
+	api := testService("api", v1.ServicePort{Port: 443, NodePort: 30443, Protocol: v1.ProtocolTCP})
+	api.Status.LoadBalancer = *loadBalancerStatus([]string{"192.168.0.9"})
+	db := testService("db", v1.ServicePort{Port: 5432, NodePort: 30432, Protocol: v1.ProtocolTCP})
+	db.Namespace = "team-a"
+
+	kubeClient := fake.NewSimpleClientset(web, api, db,
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: NetloxClientConfig, Namespace: "default"},
+			Data: map[string]string{
+				NetloxServicesKey: `{"services":[` +
+					`{"vip":"192.168.0.201","uid":"web-uid","serviceName":"web","ports":[{"port":80,"nodePort":30080,"protocol":"TCP"}],"rules":[{"loxilb":"10.0.0.1","node":"lb-1","vip":"192.168.0.201","port":80,"protocol":"TCP","endpoints":["10.0.0.2:30080"]}]},` +
+					`{"vip":"192.168.0.202","uid":"api-uid","serviceName":"api"},` +
+					`{"vip":"192.168.0.204","uid":"gone-uid","serviceName":"gone"}]}`,
+			},
+		},
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: NetloxClientConfig, Namespace: "team-a"},
+			Data: map[string]string{
+				NetloxServicesKey: `{"services":[{"vip":"192.168.0.203","port":5432,"type":"TCP","uid":"db-uid","serviceName":"db","nodePort":30432}]}`,
+			},
+		},
+	)
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+
+	// Without the CRD only a dry run is possible
+	if _, err := Migrate(context.Background(), kubeClient, client, MigrateOptions{}, &bytes.Buffer{}); err == nil {
+		t.Fatalf("Migrate() expected an error without the LoxiLoadBalancer CRD")
+	}
+	kubeClient.Resources = []*metav1.APIResourceList{{
+		GroupVersion: v1alpha1.SchemeGroupVersion.String(),
+		APIResources: []metav1.APIResource{{Name: v1alpha1.LoxiLoadBalancerResource.Resource, Namespaced: true, Kind: "LoxiLoadBalancer"}},
+	}}
+
+	out := &bytes.Buffer{}
+	result, err := Migrate(context.Background(), kubeClient, client, MigrateOptions{DryRun: true}, out)
+	if err != nil {
+		t.Fatalf("Migrate() dry run error = %v", err)
+	}
+	if want := (MigrateResult{Migrated: 2, Skipped: 2}); *result != want {
+		t.Errorf("Migrate() dry run = %+v, want %+v", *result, want)
+	}
+	for _, want := range []string{
+		"+++ loxiloadbalancers/default/web",
+		`-  "vip": "192.168.0.201",`,
+		"+  - 192.168.0.201",
+		"+++ loxiloadbalancers/team-a/db",
+		"# default/api skipped, recorded vips [192.168.0.202] don't match the service status [192.168.0.9]",
+		"# default/gone skipped, no service with uid [gone-uid] exists",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Migrate() dry run output doesn't contain %q:\n%s", want, out.String())
+		}
+	}
+	list, err := client.Resource(v1alpha1.LoxiLoadBalancerResource).Namespace(metav1.NamespaceAll).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Items) != 0 {
+		t.Fatalf("Migrate() dry run created %d LoxiLoadBalancers", len(list.Items))
+	}
+
+	result, err = Migrate(context.Background(), kubeClient, client, MigrateOptions{}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	if want := (MigrateResult{Migrated: 2, Skipped: 2}); *result != want {
+		t.Errorf("Migrate() = %+v, want %+v", *result, want)
+	}
+
+	lb := &loadbalancers{kubeClient: kubeClient, cloudConfigMap: NetloxClientConfig}
+	for _, tt := range []struct {
+		service *v1.Service
+		vips    []string
+		rules   int
+	}{
+		{service: web, vips: []string{"192.168.0.201"}, rules: 1},
+		{service: db, vips: []string{"192.168.0.203"}},
+	} {
+		got := getTestLoxiLoadBalancer(t, client, tt.service)
+		if got == nil {
+			t.Errorf("no LoxiLoadBalancer for %s", tt.service.Name)
+			continue
+		}
+		if !reflect.DeepEqual(got.Status.VIPs, tt.vips) || len(got.Status.Rules) != tt.rules || got.Spec.ServiceUID != tt.service.UID {
+			t.Errorf("LoxiLoadBalancer %s = %+v, want vips %v and %d rules", tt.service.Name, got, tt.vips, tt.rules)
+		}
+		if entry := findTestService(t, lb, tt.service); entry != nil {
+			t.Errorf("%s is still recorded in the configMap", tt.service.Name)
+		}
+	}
+	for _, name := range []string{"api", "gone"} {
+		if entry := findTestService(t, lb, testService(name)); entry == nil {
+			t.Errorf("%s isn't recorded in the configMap anymore", name)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package netlox
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// powerSource reports the power state of the instances
+type powerSource interface {
+	// shutdown returns true if the instance is powered off
+	shutdown(ctx context.Context, inst *instance) (bool, error)
+}
+
+// redfishPowerStateOff is the power state of a Redfish ComputerSystem that is shut down
+const redfishPowerStateOff = "Off"
+
+// redfishPower reads the power state of an instance from the Redfish ComputerSystem at its BMC URL (e.g.
+// https://10.0.1.1/redfish/v1/Systems/1). Instances without a BMC are never reported as shut down, as
+// their power state isn't known.
+type redfishPower struct {
+	client   *http.Client
+	username string
+	password string
+}
+
+var _ powerSource = &redfishPower{}
+
+func newRedfishPower(username, password string, insecure bool) *redfishPower {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		// BMCs commonly serve self-signed certificates
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &redfishPower{
+		client:   &http.Client{Transport: transport, Timeout: 10 * time.Second},
+		username: username,
+		password: password,
+	}
+}
+
+// redfishSystem is the part of a Redfish ComputerSystem that is read
+type redfishSystem struct {
+	PowerState string `json:"PowerState"`
+}
+
+func (r *redfishPower) shutdown(ctx context.Context, inst *instance) (bool, error) {
+	if inst.BMC == "" {
+		return false, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, inst.BMC, nil)
+	if err != nil {
+		return false, fmt.Errorf("Invalid BMC [%s] of instance [%s] : %v", inst.BMC, inst.Name, err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if r.username != "" {
+		req.SetBasicAuth(r.username, r.password)
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("Unable to retrieve the power state of instance [%s] : %v", inst.Name, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, fmt.Errorf("Unable to retrieve the power state of instance [%s] : BMC returned [%s] %s", inst.Name, resp.Status, body)
+	}
+	var system redfishSystem
+	if err := json.NewDecoder(resp.Body).Decode(&system); err != nil {
+		return false, fmt.Errorf("Unable to read the power state of instance [%s] : %v", inst.Name, err)
+	}
+	return system.PowerState == redfishPowerStateOff, nil
+}
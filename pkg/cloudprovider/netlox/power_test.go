@@ -0,0 +1,102 @@
+package netlox
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	cloudprovider "k8s.io/cloud-provider"
+)
+
+// staticInventory is an inventory of fixed instances
+type staticInventory []instance
+
+func (s staticInventory) instances(ctx context.Context) ([]instance, error) {
+	return s, nil
+}
+
+func (s staticInventory) zones(ctx context.Context) ([]zoneRange, error) {
+	return nil, nil
+}
+
+func (s staticInventory) read(ctx context.Context) (*inventoryFile, error) {
+	return &inventoryFile{Instances: s}, nil
+}
+
+// fakeRedfish serves the PowerState of Redfish ComputerSystems, systems without a state return 404
+type fakeRedfish struct {
+	*httptest.Server
+	mu     sync.Mutex
+	states map[string]string
+}
+
+func newFakeRedfish() *fakeRedfish {
+	f := &fakeRedfish{states: map[string]string{}}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "admin" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.mu.Lock()
+		state, ok := f.states[r.URL.Path]
+		f.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"@odata.id":%q,"PowerState":%q}`, r.URL.Path, state)
+	}))
+	return f
+}
+
+func (f *fakeRedfish) setPowerState(system, state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.states[system] = state
+}
+
+func TestInstanceShutdown_redfish(t *testing.T) {
+	bmc := newFakeRedfish()
+	defer bmc.Close()
+	bmc.setPowerState("/redfish/v1/Systems/1", "On")
+	bmc.setPowerState("/redfish/v1/Systems/2", "Off")
+
+	i := newInstances(staticInventory{
+		{Name: "worker-1", ID: "w-1", BMC: bmc.URL + "/redfish/v1/Systems/1"},
+		{Name: "worker-2", ID: "w-2", BMC: bmc.URL + "/redfish/v1/Systems/2"},
+		{Name: "worker-3", ID: "w-3"},
+		{Name: "worker-4", ID: "w-4", BMC: bmc.URL + "/redfish/v1/Systems/4"},
+	}, newRedfishPower("admin", "secret", false))
+	ctx := context.Background()
+
+	tests := []struct {
+		providerID string
+		want       bool
+		wantErr    error
+	}{
+		{providerID: "netlox://w-1", want: false},
+		{providerID: "netlox://w-2", want: true},
+		// Without a BMC the power state isn't known
+		{providerID: "netlox://w-3", want: false},
+		{providerID: "netlox://w-5", wantErr: cloudprovider.InstanceNotFound},
+	}
+	for _, tt := range tests {
+		got, err := i.InstanceShutdownByProviderID(ctx, tt.providerID)
+		if err != tt.wantErr || got != tt.want {
+			t.Errorf("InstanceShutdownByProviderID(%s) = %v, %v, want %v, %v", tt.providerID, got, err, tt.want, tt.wantErr)
+		}
+	}
+
+	// A BMC that can't report the state is an error, not a shut down (or healthy) instance
+	if _, err := i.InstanceShutdownByProviderID(ctx, "netlox://w-4"); err == nil || err == cloudprovider.InstanceNotFound {
+		t.Errorf("InstanceShutdownByProviderID(netlox://w-4) error = %v, want the BMC error", err)
+	}
+	unauthorized := newInstances(staticInventory{{Name: "worker-1", ID: "w-1", BMC: bmc.URL + "/redfish/v1/Systems/1"}}, newRedfishPower("admin", "wrong", false))
+	if _, err := unauthorized.InstanceShutdownByProviderID(ctx, "netlox://w-1"); err == nil {
+		t.Errorf("InstanceShutdownByProviderID() expected an error with the wrong credentials")
+	}
+}
@@ -0,0 +1,339 @@
+package netlox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	cloudprovider "k8s.io/cloud-provider"
+	"k8s.io/klog"
+	"netlox.io/netlox/pkg/ipam"
+	"netlox.io/netlox/pkg/loxilb"
+)
+
+const (
+	// NetloxRoutesConfig is the configMap (in kube-system) recording the routes programmed on LoxiLB, only
+	// those are managed: the other routes of the LoxiLB nodes are never listed, and so never deleted
+	NetloxRoutesConfig = "netlox-routes"
+
+	// NetloxRoutesKey is the key in the ConfigMap that has the recorded routes
+	NetloxRoutesKey = "routes"
+)
+
+// routes programs the pod CIDR of every node as a route on the LoxiLB nodes, with the node as the gateway,
+// so the pods are reachable through LoxiLB without an overlay. A LoxiLB node doesn't get a route to its
+// own pod CIDR.
+type routes struct {
+	kubeClient kubernetes.Interface
+	client     *netloxClient
+}
+
+var _ cloudprovider.Routes = &routes{}
+
+func newRoutes(kubeClient kubernetes.Interface, client *netloxClient) *routes {
+	return &routes{
+		kubeClient: kubeClient,
+		client:     client,
+	}
+}
+
+// routeName names the route of a node's pod CIDR, a route to no known node is named after its destination
+func routeName(node types.NodeName, destinationCIDR string) string {
+	if node == "" {
+		return destinationCIDR
+	}
+	return fmt.Sprintf("%s-%s", node, destinationCIDR)
+}
+
+// routeGateway returns the address of the node that traffic for the destination is sent to, of the same
+// family as the destination
+func routeGateway(node *v1.Node, destinationCIDR string) (string, error) {
+	ip, _, err := net.ParseCIDR(destinationCIDR)
+	if err != nil {
+		return "", fmt.Errorf("Invalid route destination [%s] : %v", destinationCIDR, err)
+	}
+	family, err := ipam.FamilyOf(ip.String())
+	if err != nil {
+		return "", err
+	}
+	gateway := nodeAddressOfFamily(node, family)
+	if gateway == "" {
+		return "", fmt.Errorf("Node [%s] has no address to route [%s] to", node.Name, destinationCIDR)
+	}
+	return gateway, nil
+}
+
+// listNodes returns every node
+func (r *routes) listNodes(ctx context.Context) ([]*v1.Node, error) {
+	list, err := r.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list nodes : %v", err)
+	}
+	nodes := make([]*v1.Node, 0, len(list.Items))
+	for x := range list.Items {
+		nodes = append(nodes, &list.Items[x])
+	}
+	return nodes, nil
+}
+
+// managedRoutes returns the routes recorded in the routes configMap and the configMap, nil if there is none
+func (r *routes) managedRoutes(ctx context.Context) (*v1.ConfigMap, map[loxilb.Route]bool, error) {
+	managed := map[loxilb.Route]bool{}
+	cm, err := r.kubeClient.CoreV1().ConfigMaps("kube-system").Get(ctx, NetloxRoutesConfig, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, managed, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to retrieve configMap [%s] in kube-system : %v", NetloxRoutesConfig, err)
+	}
+	var recorded []loxilb.Route
+	if b, ok := cm.Data[NetloxRoutesKey]; ok {
+		if err := json.Unmarshal([]byte(b), &recorded); err != nil {
+			return nil, nil, fmt.Errorf("Unable to read the routes of configMap [%s] in kube-system : %v", NetloxRoutesConfig, err)
+		}
+	}
+	for _, route := range recorded {
+		managed[route] = true
+	}
+	return cm, managed, nil
+}
+
+// recordRoutes applies change to the recorded routes, creating the routes configMap if needed. change returns
+// false if there is nothing to update. A configMap updated by another writer first is re-read.
+func (r *routes) recordRoutes(ctx context.Context, change func(managed map[loxilb.Route]bool) bool) error {
+	return retry.OnError(configMapRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		cm, managed, err := r.managedRoutes(ctx)
+		if err != nil {
+			return err
+		}
+		if !change(managed) {
+			return nil
+		}
+		recorded := make([]loxilb.Route, 0, len(managed))
+		for route := range managed {
+			recorded = append(recorded, route)
+		}
+		sort.Slice(recorded, func(i, j int) bool {
+			if recorded[i].DestinationIPNet != recorded[j].DestinationIPNet {
+				return recorded[i].DestinationIPNet < recorded[j].DestinationIPNet
+			}
+			return recorded[i].Gateway < recorded[j].Gateway
+		})
+		b, err := json.Marshal(recorded)
+		if err != nil {
+			return err
+		}
+
+		if cm == nil {
+			cm = &v1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: NetloxRoutesConfig, Namespace: "kube-system"},
+				Data:       map[string]string{NetloxRoutesKey: string(b)},
+			}
+			_, err = r.kubeClient.CoreV1().ConfigMaps("kube-system").Create(ctx, cm, metav1.CreateOptions{})
+			return err
+		}
+		cm = cm.DeepCopy()
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		cm.Data[NetloxRoutesKey] = string(b)
+		_, err = r.kubeClient.CoreV1().ConfigMaps("kube-system").Update(ctx, cm, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// ListRoutes lists all managed routes that belong to the specified clusterName, which are the routes recorded
+// when they were created, any other route of the LoxiLB nodes is left alone. A route is only listed
+// once it is programmed on every LoxiLB node (but its target), so that a partially programmed route is
+// created again, unless it no longer matches the pod CIDR of its node and should be deleted.
+func (r *routes) ListRoutes(ctx context.Context, clusterName string) ([]*cloudprovider.Route, error) {
+	klog.V(5).Infof("ListRoutes(%v)", clusterName)
+	nodes, err := r.listNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byAddress := map[string]*v1.Node{}
+	for _, node := range nodes {
+		for _, addr := range node.Status.Addresses {
+			byAddress[addr.Address] = node
+		}
+	}
+	lbNodes := loadBalancerNodes(nodes)
+	_, managed, err := r.managedRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// programmed counts the LoxiLB nodes every route is programmed on
+	programmed := map[loxilb.Route]int{}
+	var order []loxilb.Route
+	for _, lbNode := range lbNodes {
+		client, err := r.client.loxiLB(nodeAddress(lbNode))
+		if err != nil {
+			return nil, err
+		}
+		loxiRoutes, err := client.ListRoutes(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list routes of LoxiLB node [%s] : %v", lbNode.Name, err)
+		}
+		for _, route := range loxiRoutes {
+			if !managed[route] {
+				continue
+			}
+			if programmed[route] == 0 {
+				order = append(order, route)
+			}
+			programmed[route]++
+		}
+	}
+
+	var list []*cloudprovider.Route
+	for _, route := range order {
+		var target types.NodeName
+		expected := len(lbNodes)
+		if node, ok := byAddress[route.Gateway]; ok {
+			target = types.NodeName(node.Name)
+			if node.Labels[loadBalancerLabel] == loadBalancerLabelValue {
+				expected--
+			}
+			if programmed[route] < expected && hasPodCIDR(node, route.DestinationIPNet) {
+				continue
+			}
+		}
+		list = append(list, &cloudprovider.Route{
+			Name:            routeName(target, route.DestinationIPNet),
+			TargetNode:      target,
+			DestinationCIDR: route.DestinationIPNet,
+		})
+	}
+	return list, nil
+}
+
+// hasPodCIDR returns true if the destination is a pod CIDR of the node
+func hasPodCIDR(node *v1.Node, destinationCIDR string) bool {
+	if node.Spec.PodCIDR == destinationCIDR {
+		return true
+	}
+	for _, cidr := range node.Spec.PodCIDRs {
+		if cidr == destinationCIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateRoute creates the described managed route
+// route.Name will be ignored, although the cloud-provider may use nameHint
+// to create a more user-meaningful name.
+func (r *routes) CreateRoute(ctx context.Context, clusterName string, nameHint string, route *cloudprovider.Route) error {
+	klog.V(5).Infof("CreateRoute(%v, %v, %v)", clusterName, nameHint, route)
+	nodes, err := r.listNodes(ctx)
+	if err != nil {
+		return err
+	}
+	var target *v1.Node
+	for _, node := range nodes {
+		if node.Name == string(route.TargetNode) {
+			target = node
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("Unable to create route [%s], node [%s] doesn't exist", route.DestinationCIDR, route.TargetNode)
+	}
+	gateway, err := routeGateway(target, route.DestinationCIDR)
+	if err != nil {
+		return err
+	}
+	lbNodes := loadBalancerNodes(nodes)
+	if len(lbNodes) == 0 {
+		return fmt.Errorf("No nodes labelled [%s=%s] to route [%s] on", loadBalancerLabel, loadBalancerLabelValue, route.DestinationCIDR)
+	}
+
+	// The route is recorded first, so that it is listed (and so deleted) even if it is only partially programmed
+	loxiRoute := &loxilb.Route{DestinationIPNet: route.DestinationCIDR, Gateway: gateway}
+	err = r.recordRoutes(ctx, func(managed map[loxilb.Route]bool) bool {
+		if managed[*loxiRoute] {
+			return false
+		}
+		managed[*loxiRoute] = true
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to record route [%s] : %v", route.DestinationCIDR, err)
+	}
+	var errs []error
+	for _, lbNode := range lbNodes {
+		if lbNode.Name == target.Name {
+			continue
+		}
+		client, err := r.client.loxiLB(nodeAddress(lbNode))
+		if err == nil {
+			err = client.CreateRoute(ctx, loxiRoute)
+		}
+		if loxilb.IsAlreadyExists(err) {
+			err = nil
+		}
+		if err != nil {
+			klog.Errorf("Unable to program route [%s] via [%s] on LoxiLB node [%s] : %v", route.DestinationCIDR, gateway, lbNode.Name, err)
+			errs = append(errs, fmt.Errorf("node [%s] : %v", lbNode.Name, err))
+			continue
+		}
+		klog.Infof("Programmed route [%s] via [%s] (node [%s]) on LoxiLB node [%s]", route.DestinationCIDR, gateway, target.Name, lbNode.Name)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// DeleteRoute deletes the specified managed route
+// Route should be as returned by ListRoutes
+func (r *routes) DeleteRoute(ctx context.Context, clusterName string, route *cloudprovider.Route) error {
+	klog.V(5).Infof("DeleteRoute(%v, %v)", clusterName, route)
+	nodes, err := r.listNodes(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, lbNode := range loadBalancerNodes(nodes) {
+		client, err := r.client.loxiLB(nodeAddress(lbNode))
+		if err == nil {
+			err = client.DeleteRoute(ctx, route.DestinationCIDR)
+		}
+		if loxilb.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			klog.Errorf("Unable to remove route [%s] from LoxiLB node [%s] : %v", route.DestinationCIDR, lbNode.Name, err)
+			errs = append(errs, fmt.Errorf("node [%s] : %v", lbNode.Name, err))
+			continue
+		}
+		klog.Infof("Removed route [%s] from LoxiLB node [%s]", route.DestinationCIDR, lbNode.Name)
+	}
+	if len(errs) != 0 {
+		return utilerrors.NewAggregate(errs)
+	}
+	// The route is only forgotten once it is removed from every LoxiLB node
+	err = r.recordRoutes(ctx, func(managed map[loxilb.Route]bool) bool {
+		changed := false
+		for recorded := range managed {
+			if recorded.DestinationIPNet == route.DestinationCIDR {
+				delete(managed, recorded)
+				changed = true
+			}
+		}
+		return changed
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to forget route [%s] : %v", route.DestinationCIDR, err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package netlox
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	cloudprovider "k8s.io/cloud-provider"
+	"netlox.io/netlox/pkg/loxilb"
+)
+
+func TestRoutes(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	withPodCIDR := func(node *v1.Node, cidr string) runtime.Object {
+		node.Spec.PodCIDR = cidr
+		node.Spec.PodCIDRs = []string{cidr}
+		return node
+	}
+	kubeClient := fake.NewSimpleClientset(
+		withPodCIDR(testNode("lb-1", "10.0.0.1", true), "10.244.0.0/24"),
+		withPodCIDR(testNode("lb-2", "10.0.0.2", true), "10.244.1.0/24"),
+		withPodCIDR(testNode("worker-1", "10.0.0.3", false), "10.244.2.0/24"),
+		withPodCIDR(testNode("worker-2", "10.0.0.4", false), "10.244.3.0/24"),
+	)
+	r := newRoutes(kubeClient, f.client())
+	ctx := context.Background()
+
+	for _, route := range []*cloudprovider.Route{
+		{TargetNode: "lb-1", DestinationCIDR: "10.244.0.0/24"},
+		{TargetNode: "worker-1", DestinationCIDR: "10.244.2.0/24"},
+	} {
+		if err := r.CreateRoute(ctx, "kubernetes", "hint", route); err != nil {
+			t.Fatalf("CreateRoute(%s) error = %v", route.TargetNode, err)
+		}
+	}
+	// A LoxiLB node doesn't route its own pod CIDR
+	if got, want := f.routeGateways("10.0.0.1"), map[string]string{"10.244.2.0/24": "10.0.0.3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lb-1 routes = %v, want %v", got, want)
+	}
+	if got, want := f.routeGateways("10.0.0.2"), map[string]string{"10.244.0.0/24": "10.0.0.1", "10.244.2.0/24": "10.0.0.3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lb-2 routes = %v, want %v", got, want)
+	}
+	// Creating a route again isn't an error
+	if err := r.CreateRoute(ctx, "kubernetes", "hint", &cloudprovider.Route{TargetNode: "worker-1", DestinationCIDR: "10.244.2.0/24"}); err != nil {
+		t.Errorf("CreateRoute() of an existing route error = %v", err)
+	}
+	if err := r.CreateRoute(ctx, "kubernetes", "hint", &cloudprovider.Route{TargetNode: "worker-9", DestinationCIDR: "10.244.9.0/24"}); err == nil {
+		t.Errorf("CreateRoute() expected an error for an unknown node")
+	}
+
+	// worker-2 is only routed by lb-1, so it is left to be created again, while the route to an address
+	// no node has is listed to be deleted. Both were recorded when they were created, unlike the route
+	// configured on lb-1 outside of the cluster, which is never listed.
+	if err := r.recordRoutes(ctx, func(managed map[loxilb.Route]bool) bool {
+		managed[loxilb.Route{DestinationIPNet: "10.244.3.0/24", Gateway: "10.0.0.4"}] = true
+		managed[loxilb.Route{DestinationIPNet: "10.244.8.0/24", Gateway: "10.0.0.8"}] = true
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	f.setRoute("10.0.0.1", "10.244.3.0/24", "10.0.0.4")
+	f.setRoute("10.0.0.2", "10.244.8.0/24", "10.0.0.8")
+	f.setRoute("10.0.0.1", "10.244.200.0/24", "10.0.0.3")
+	list, err := r.ListRoutes(ctx, "kubernetes")
+	if err != nil {
+		t.Fatalf("ListRoutes() error = %v", err)
+	}
+	var got []cloudprovider.Route
+	for _, route := range list {
+		got = append(got, *route)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].DestinationCIDR < got[j].DestinationCIDR })
+	want := []cloudprovider.Route{
+		{Name: "lb-1-10.244.0.0/24", TargetNode: "lb-1", DestinationCIDR: "10.244.0.0/24"},
+		{Name: "worker-1-10.244.2.0/24", TargetNode: "worker-1", DestinationCIDR: "10.244.2.0/24"},
+		{Name: "10.244.8.0/24", DestinationCIDR: "10.244.8.0/24"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListRoutes() = %+v, want %+v", got, want)
+	}
+
+	// A LoxiLB that can't be programmed fails the route, the others still get it
+	f.setFailing("10.0.0.2", true)
+	if err := r.CreateRoute(ctx, "kubernetes", "hint", &cloudprovider.Route{TargetNode: "worker-2", DestinationCIDR: "10.244.3.0/24"}); err == nil {
+		t.Errorf("CreateRoute() expected an error for lb-2")
+	}
+	if _, err := r.ListRoutes(ctx, "kubernetes"); err == nil {
+		t.Errorf("ListRoutes() expected an error for lb-2")
+	}
+	f.setFailing("10.0.0.2", false)
+
+	if err := r.DeleteRoute(ctx, "kubernetes", &want[2]); err != nil {
+		t.Fatalf("DeleteRoute() error = %v", err)
+	}
+	if err := r.DeleteRoute(ctx, "kubernetes", &want[1]); err != nil {
+		t.Fatalf("DeleteRoute() error = %v", err)
+	}
+	for address, want := range map[string]map[string]string{
+		"10.0.0.1": {"10.244.3.0/24": "10.0.0.4", "10.244.200.0/24": "10.0.0.3"},
+		"10.0.0.2": {"10.244.0.0/24": "10.0.0.1"},
+	} {
+		if got := f.routeGateways(address); !reflect.DeepEqual(got, want) {
+			t.Errorf("routes of %s = %v, want %v", address, got, want)
+		}
+	}
+	_, managed, err := r.managedRoutes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantManaged := map[loxilb.Route]bool{
+		{DestinationIPNet: "10.244.0.0/24", Gateway: "10.0.0.1"}: true,
+		{DestinationIPNet: "10.244.3.0/24", Gateway: "10.0.0.4"}: true,
+	}
+	if !reflect.DeepEqual(managed, wantManaged) {
+		t.Errorf("recorded routes = %v, want %v", managed, wantManaged)
+	}
+}
@@ -2,21 +2,173 @@ package netlox
 
 import (
 	"context"
-	"net/http"
+	"fmt"
+	"net"
+	"os"
+	"strings"
 
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
 	cloudprovider "k8s.io/cloud-provider"
 	"k8s.io/klog"
 )
 
+// zoneSource is where the zone of a node is resolved from
+type zoneSource string
+
+const (
+	// zoneSourceLabel reads the zone from the zoneLabel (and regionLabel) of the node
+	zoneSourceLabel zoneSource = "label"
+	// zoneSourceInventory reads the zone from the inventory record of the node
+	zoneSourceInventory zoneSource = "inventory"
+	// zoneSourceCIDR reads the zone from the inventory zones whose cidr has an address of the node
+	zoneSourceCIDR zoneSource = "cidr"
+
+	// zoneLabel and regionLabel are set by the administrator on nodes to give their failure domain
+	zoneLabel   = "netlox.io/zone"
+	regionLabel = "netlox.io/region"
+)
+
+// defaultZoneSources are the zone sources, in the order they are tried, unless NETLOX_ZONE_SOURCES is set
+var defaultZoneSources = []zoneSource{zoneSourceLabel, zoneSourceInventory, zoneSourceCIDR}
+
+// parseZoneSources reads a comma separated list of zone sources, e.g. "inventory,cidr"
+func parseZoneSources(sources string) ([]zoneSource, error) {
+	if sources == "" {
+		return defaultZoneSources, nil
+	}
+	var parsed []zoneSource
+	for _, source := range strings.Split(sources, ",") {
+		switch s := zoneSource(strings.TrimSpace(source)); s {
+		case zoneSourceLabel, zoneSourceInventory, zoneSourceCIDR:
+			parsed = append(parsed, s)
+		default:
+			return nil, fmt.Errorf("Unknown zone source [%s], expected one of %v", source, defaultZoneSources)
+		}
+	}
+	return parsed, nil
+}
+
+// zones resolves the failure domain of the nodes from the first of its sources that has one, a node no
+// source has a zone for is in no zone
 type zones struct {
-	client *http.Client
+	kubeClient kubernetes.Interface
+	// instances are the inventory, nil when none is configured
+	instances *instances
+	sources   []zoneSource
 }
 
-func newZones(c *http.Client) cloudprovider.Zones {
+var _ cloudprovider.Zones = &zones{}
+
+func newZones(kubeClient kubernetes.Interface, instances *instances, sources []zoneSource) *zones {
 	return &zones{
-		c,
+		kubeClient: kubeClient,
+		instances:  instances,
+		sources:    sources,
+	}
+}
+
+// snapshot returns the zones resolved from the inventory as it is now, read once for all the lookups (e.g.
+// of every node of a sync)
+func (z *zones) snapshot(ctx context.Context) (*zones, error) {
+	if z.instances == nil {
+		return z, nil
+	}
+	inv, err := z.instances.inventory.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newZones(z.kubeClient, newInstances(inv, z.instances.power), z.sources), nil
+}
+
+// resolve returns the zone of the node and/or its instance, either may be nil when it isn't known
+func (z *zones) resolve(ctx context.Context, node *v1.Node, inst *instance) (cloudprovider.Zone, error) {
+	for _, source := range z.sources {
+		var zone cloudprovider.Zone
+		switch source {
+		case zoneSourceLabel:
+			if node != nil {
+				zone = cloudprovider.Zone{FailureDomain: node.Labels[zoneLabel], Region: node.Labels[regionLabel]}
+			}
+		case zoneSourceInventory:
+			if inst != nil {
+				zone = cloudprovider.Zone{FailureDomain: inst.Zone, Region: inst.Region}
+			}
+		case zoneSourceCIDR:
+			var addresses []v1.NodeAddress
+			if node != nil {
+				addresses = node.Status.Addresses
+			} else if inst != nil {
+				addresses = inst.Addresses
+			}
+			var err error
+			zone, err = z.zoneOfAddresses(ctx, addresses)
+			if err != nil {
+				return cloudprovider.Zone{}, err
+			}
+		}
+		if zone.FailureDomain != "" {
+			return zone, nil
+		}
+	}
+	return cloudprovider.Zone{}, nil
+}
+
+// zoneOfAddresses returns the zone of the first inventory zone whose cidr has one of the addresses, the
+// InternalIPs are matched first
+func (z *zones) zoneOfAddresses(ctx context.Context, addresses []v1.NodeAddress) (cloudprovider.Zone, error) {
+	if len(addresses) == 0 || z.instances == nil {
+		return cloudprovider.Zone{}, nil
+	}
+	ranges, err := z.instances.inventory.zones(ctx)
+	if err != nil {
+		return cloudprovider.Zone{}, err
 	}
+	for _, internal := range []bool{true, false} {
+		for _, addr := range addresses {
+			if (addr.Type == v1.NodeInternalIP) != internal {
+				continue
+			}
+			ip := net.ParseIP(addr.Address)
+			if ip == nil {
+				continue
+			}
+			for _, r := range ranges {
+				_, cidr, err := net.ParseCIDR(r.CIDR)
+				if err == nil && cidr.Contains(ip) {
+					return cloudprovider.Zone{FailureDomain: r.Zone, Region: r.Region}, nil
+				}
+			}
+		}
+	}
+	return cloudprovider.Zone{}, nil
+}
+
+// instance returns the instance found by lookup in the inventory, nil when there is no inventory or the
+// instance isn't in it
+func (z *zones) instance(lookup func(i *instances) (*instance, error)) (*instance, error) {
+	if z.instances == nil {
+		return nil, nil
+	}
+	inst, err := lookup(z.instances)
+	if err == cloudprovider.InstanceNotFound {
+		return nil, nil
+	}
+	return inst, err
+}
+
+// zoneOfNode returns the zone of the node, with its instance found as instanceOfNode does
+func (z *zones) zoneOfNode(ctx context.Context, node *v1.Node) (cloudprovider.Zone, error) {
+	inst, err := z.instance(func(i *instances) (*instance, error) {
+		return i.instanceOfNode(ctx, node)
+	})
+	if err != nil {
+		return cloudprovider.Zone{}, err
+	}
+	return z.resolve(ctx, node, inst)
 }
 
 // GetZone returns the Zone containing the current failure zone and locality region that the program is running in
@@ -25,10 +177,12 @@ func newZones(c *http.Client) cloudprovider.Zones {
 // can no longer be called from the kubelets.
 func (z *zones) GetZone(ctx context.Context) (cloudprovider.Zone, error) {
 	klog.V(5).Info("GetZone()")
-	return cloudprovider.Zone{
-		FailureDomain: "laptop",
-		Region:        "virtualbox",
-	}, nil
+	// As for CurrentNodeName, the node we are running on is named after the hostname
+	hostname, err := os.Hostname()
+	if err != nil {
+		return cloudprovider.Zone{}, fmt.Errorf("Unable to retrieve the hostname : %v", err)
+	}
+	return z.GetZoneByNodeName(ctx, types.NodeName(hostname))
 }
 
 // GetZoneByProviderID returns the Zone containing the current zone and locality region of the node specified by providerID
@@ -36,10 +190,32 @@ func (z *zones) GetZone(ctx context.Context) (cloudprovider.Zone, error) {
 // outside the kubelets.
 func (z *zones) GetZoneByProviderID(ctx context.Context, providerID string) (cloudprovider.Zone, error) {
 	klog.V(5).Infof("GetZoneByProviderID(%v)", providerID)
-	return cloudprovider.Zone{
-		FailureDomain: "virtualbox",
-		Region:        "virtualbox",
-	}, nil
+	id, err := parseProviderID(providerID)
+	if err != nil {
+		return cloudprovider.Zone{}, err
+	}
+	inst, err := z.instance(func(i *instances) (*instance, error) {
+		return i.instanceByProviderID(ctx, providerID)
+	})
+	if err != nil {
+		return cloudprovider.Zone{}, err
+	}
+
+	nodes, err := z.kubeClient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return cloudprovider.Zone{}, fmt.Errorf("Unable to list nodes : %v", err)
+	}
+	var node *v1.Node
+	for x := range nodes.Items {
+		if nodeID, err := parseProviderID(nodes.Items[x].Spec.ProviderID); err == nil && nodeID == id {
+			node = &nodes.Items[x]
+			break
+		}
+	}
+	if node == nil && inst == nil {
+		return cloudprovider.Zone{}, cloudprovider.InstanceNotFound
+	}
+	return z.resolve(ctx, node, inst)
 }
 
 // GetZoneByNodeName returns the Zone containing the current zone and locality region of the node specified by node name
@@ -47,8 +223,22 @@ func (z *zones) GetZoneByProviderID(ctx context.Context, providerID string) (clo
 // outside the kubelets.
 func (z *zones) GetZoneByNodeName(ctx context.Context, nodeName types.NodeName) (cloudprovider.Zone, error) {
 	klog.V(5).Infof("GetZoneByNodeName(%v)", nodeName)
-	return cloudprovider.Zone{
-		FailureDomain: "virtualbox",
-		Region:        "virtualbox",
-	}, nil
-}
\ No newline at end of file
+	inst, err := z.instance(func(i *instances) (*instance, error) {
+		return i.instanceByName(ctx, nodeName)
+	})
+	if err != nil {
+		return cloudprovider.Zone{}, err
+	}
+
+	node, err := z.kubeClient.CoreV1().Nodes().Get(ctx, string(nodeName), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		node, err = nil, nil
+	}
+	if err != nil {
+		return cloudprovider.Zone{}, fmt.Errorf("Unable to retrieve node [%s] : %v", nodeName, err)
+	}
+	if node == nil && inst == nil {
+		return cloudprovider.Zone{}, cloudprovider.InstanceNotFound
+	}
+	return z.resolve(ctx, node, inst)
+}
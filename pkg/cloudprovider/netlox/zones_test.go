@@ -0,0 +1,181 @@
+package netlox
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	cloudprovider "k8s.io/cloud-provider"
+)
+
+const testZonesInventory = testInventory + `
+zones:
+  - cidr: 10.0.0.0/24
+    zone: rack-2
+    region: dc-1
+  - cidr: 10.0.1.0/24
+    zone: rack-3
+`
+
+func TestZones(t *testing.T) {
+	labelled := testNode("labelled", "10.0.1.5", false)
+	labelled.Labels[zoneLabel] = "rack-9"
+	labelled.Labels[regionLabel] = "dc-2"
+	worker := testNode("worker-1", "10.0.0.2", false)
+	worker.Spec.ProviderID = "netlox://w-1"
+	kubeClient := fake.NewSimpleClientset(labelled, worker,
+		testNode("master-1", "10.0.0.1", false),
+		testNode("elsewhere", "172.16.0.1", false),
+		&v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: NetloxInventoryConfig, Namespace: "kube-system"},
+			Data:       map[string]string{NetloxInventoryKey: testZonesInventory},
+		},
+	)
+	i := newInstances(&configMapInventory{kubeClient: kubeClient, namespace: "kube-system", name: NetloxInventoryConfig}, nil)
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		sources []zoneSource
+		node    types.NodeName
+		want    cloudprovider.Zone
+		wantErr error
+	}{
+		{name: "label", node: "labelled", want: cloudprovider.Zone{FailureDomain: "rack-9", Region: "dc-2"}},
+		{name: "inventory", node: "master-1", want: cloudprovider.Zone{FailureDomain: "rack-1", Region: "dc-1"}},
+		{name: "cidr", node: "worker-1", want: cloudprovider.Zone{FailureDomain: "rack-2", Region: "dc-1"}},
+		{name: "none", node: "elsewhere"},
+		{name: "only cidr", sources: []zoneSource{zoneSourceCIDR}, node: "labelled", want: cloudprovider.Zone{FailureDomain: "rack-3"}},
+		{name: "cidr before inventory", sources: []zoneSource{zoneSourceCIDR, zoneSourceInventory}, node: "master-1", want: cloudprovider.Zone{FailureDomain: "rack-2", Region: "dc-1"}},
+		{name: "unknown", node: "missing", wantErr: cloudprovider.InstanceNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources := tt.sources
+			if sources == nil {
+				sources = defaultZoneSources
+			}
+			z := newZones(kubeClient, i, sources)
+			got, err := z.GetZoneByNodeName(ctx, tt.node)
+			if err != tt.wantErr || got != tt.want {
+				t.Errorf("GetZoneByNodeName(%s) = %+v, %v, want %+v, %v", tt.node, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+
+	// Without an inventory only the labels give a zone
+	z := newZones(kubeClient, nil, defaultZoneSources)
+	for node, want := range map[types.NodeName]cloudprovider.Zone{
+		"labelled": {FailureDomain: "rack-9", Region: "dc-2"},
+		"master-1": {},
+	} {
+		if got, err := z.GetZoneByNodeName(ctx, node); err != nil || got != want {
+			t.Errorf("GetZoneByNodeName(%s) without an inventory = %+v, %v, want %+v", node, got, err, want)
+		}
+	}
+
+	z = newZones(kubeClient, i, defaultZoneSources)
+	// The node is found by its provider ID, the instance (m-1) doesn't need a node
+	for providerID, want := range map[string]cloudprovider.Zone{
+		"netlox://w-1": {FailureDomain: "rack-2", Region: "dc-1"},
+		"netlox://m-1": {FailureDomain: "rack-1", Region: "dc-1"},
+	} {
+		got, err := z.GetZoneByProviderID(ctx, providerID)
+		if err != nil || got != want {
+			t.Errorf("GetZoneByProviderID(%s) = %+v, %v, want %+v", providerID, got, err, want)
+		}
+	}
+	if _, err := z.GetZoneByProviderID(ctx, "netlox://w-9"); err != cloudprovider.InstanceNotFound {
+		t.Errorf("GetZoneByProviderID() error = %v, want InstanceNotFound", err)
+	}
+	if _, err := z.GetZoneByProviderID(ctx, "other://w-1"); err == nil {
+		t.Errorf("GetZoneByProviderID() expected an error for a provider ID of another provider")
+	}
+}
+
+func TestParseZoneSources(t *testing.T) {
+	sources, err := parseZoneSources("cidr, label")
+	if err != nil || !reflect.DeepEqual(sources, []zoneSource{zoneSourceCIDR, zoneSourceLabel}) {
+		t.Errorf("parseZoneSources() = %v, %v", sources, err)
+	}
+	if sources, err = parseZoneSources(""); err != nil || !reflect.DeepEqual(sources, defaultZoneSources) {
+		t.Errorf("parseZoneSources(\"\") = %v, %v, want the default sources", sources, err)
+	}
+	if _, err = parseZoneSources("label,metadata"); err == nil {
+		t.Errorf("parseZoneSources() expected an error for an unknown source")
+	}
+}
+
+func TestNodeZones_readsInventoryOnce(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: NetloxInventoryConfig, Namespace: "kube-system"},
+		Data:       map[string]string{NetloxInventoryKey: testZonesInventory},
+	})
+	var reads int
+	kubeClient.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reads++
+		return false, nil, nil
+	})
+	lb := &loadbalancers{
+		zones: newZones(kubeClient, newInstances(&configMapInventory{kubeClient: kubeClient, namespace: "kube-system", name: NetloxInventoryConfig}, nil), defaultZoneSources),
+	}
+	nodes := []*v1.Node{
+		testNode("master-1", "10.0.0.1", false),
+		testNode("worker-1", "10.0.0.2", false),
+		testNode("elsewhere", "172.16.0.1", false),
+	}
+
+	got := lb.nodeZones(context.Background(), nodes)
+	if want := map[string]string{"master-1": "rack-1", "worker-1": "rack-2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nodeZones() = %v, want %v", got, want)
+	}
+	if reads != 1 {
+		t.Errorf("the inventory configMap was read %d times, want once", reads)
+	}
+}
+
+func TestEnsureLoadBalancer_prefersSameZone(t *testing.T) {
+	f := newFakeLoxiLB()
+	defer f.Close()
+
+	svc := testService("nginx", v1.ServicePort{Port: 80, NodePort: 30080, Protocol: v1.ProtocolTCP})
+	lb, kubeClient := newTestLoadBalancers(f, svc)
+	// Nodes without zone labels are resolved from the inventory
+	lb.zones = newZones(kubeClient, newInstances(staticInventory{{Name: "worker-b", ID: "w-b", Zone: "b"}}, nil), defaultZoneSources)
+
+	inZone := func(node *v1.Node, zone string) *v1.Node {
+		node.Labels[v1.LabelZoneFailureDomainStable] = zone
+		return node
+	}
+	nodes := []*v1.Node{
+		inZone(testNode("lb-a", "10.0.0.1", true), "a"),
+		inZone(testNode("lb-b", "10.0.0.2", true), "b"),
+		inZone(testNode("lb-c", "10.0.0.3", true), "c"),
+		inZone(testNode("worker-a", "10.0.0.4", false), "a"),
+		testNode("worker-b", "10.0.0.5", false),
+	}
+
+	if _, err := lb.EnsureLoadBalancer(context.Background(), "kubernetes", svc, nodes); err != nil {
+		t.Fatalf("EnsureLoadBalancer() error = %v", err)
+	}
+	entry := findTestService(t, lb, svc)
+	want := map[string][]string{
+		"lb-a": {"10.0.0.4:30080"},
+		"lb-b": {"10.0.0.5:30080"},
+		// No other node is in zone c
+		"lb-c": {"10.0.0.1:30080", "10.0.0.2:30080", "10.0.0.4:30080", "10.0.0.5:30080"},
+	}
+	got := map[string][]string{}
+	for _, rule := range entry.Rules {
+		got[rule.Node] = rule.Endpoints
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("rule endpoints = %v, want %v", got, want)
+	}
+}
@@ -2,229 +2,595 @@ package ipam
 
 import (
 	"fmt"
+	"math/big"
+	"math/rand"
 	"net"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+)
+
+// Pool describes a set of addresses that can be allocated, it is identified by its Name (e.g. the
+// configMap key it was read from) and the addresses come from its CIDR and/or Range (comma seperated).
+// A pool can mix IPv4 and IPv6 cidrs or ranges. Exclude lists the addresses, cidrs or start-end ranges
+// (comma seperated) of the pool that are never handed out, e.g. gateway or VRRP addresses.
+type Pool struct {
+	Name     string
+	CIDR     string
+	Range    string
+	Exclude  string
+	Strategy Strategy
+}
 
-	"k8s.io/klog"
+// Strategy is how the next address of a pool is picked
+type Strategy string
+
+const (
+	// LowestFree hands out the lowest free address, it is the default strategy
+	LowestFree Strategy = "lowest-free"
+	// Random hands out a free address picked at random
+	Random Strategy = "random"
+	// RoundRobin hands out the next free address after the last one allocated from the pool, so that a
+	// released address isn't reused until the rest of the pool has been
+	RoundRobin Strategy = "round-robin"
 )
 
-// Manager - handles the addresses for each namespace/vip
-var Manager []ipManager
-
-// ipManager defines the mapping to a namespace and address pool
-type ipManager struct {
-	namespace      string
-	cidr           string
-	ipRange        string
-	addressManager map[string]bool
-	hosts          []string
-}
-
-// FindAvailableHostFromRange - will look through the cidr and the address Manager and find a free address (if possible)
-func FindAvailableHostFromRange(namespace, ipRange string) (string, error) {
-
-	// Look through namespaces and update one if it exists
-	for x := range Manager {
-		if Manager[x].namespace == namespace {
-			// Check that the address range is the same
-			if Manager[x].ipRange != ipRange {
-				// If not rebuild the available hosts
-				ah, err := buildHostsFromRange(ipRange)
-				if err != nil {
-					return "", err
-				}
-				Manager[x].hosts = ah
+// Family is the IP family of an address, the values match the Kubernetes IPFamily values
+type Family string
+
+const (
+	// IPv4 is the family of IPv4 addresses
+	IPv4 Family = "IPv4"
+	// IPv6 is the family of IPv6 addresses
+	IPv6 Family = "IPv6"
+)
+
+// maxRangeSize is the largest number of addresses a single start-end range can have, anything larger is
+// almost certainly a typo (and a cidr should be used for very large pools)
+const maxRangeSize = 1 << 24
+
+// addrRange is an inclusive range of addresses of a single family, pools are kept as ranges so that
+// (IPv6) pools are never enumerated
+type addrRange struct {
+	family Family
+	first  *big.Int
+	last   *big.Int
+}
+
+// pool is the allocator state for a Pool, it is rebuilt whenever the Pool definition changes
+type pool struct {
+	Pool
+	// ranges are sorted (IPv4 first), don't overlap and have the excluded addresses removed
+	ranges []addrRange
+	// excluded are the ranges of addresses that are never handed out
+	excluded []addrRange
+	// next is where the RoundRobin strategy resumes for each family
+	next map[Family]*big.Int
+}
+
+// Allocator - handles the addresses for every pool, it is safe for concurrent use
+type Allocator struct {
+	mu sync.Mutex
+	// pools is keyed by the Pool name
+	pools map[string]*pool
+	// allocated is shared by all pools so that an address is only ever handed out once, even when
+	// pools overlap. It records the owner of every allocated address.
+	allocated map[string]string
+	rand      *rand.Rand
+}
+
+// NewAllocator returns an Allocator with no pools and no allocated addresses
+func NewAllocator() *Allocator {
+	return &Allocator{
+		pools:     map[string]*pool{},
+		allocated: map[string]string{},
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Allocate - will look through the pool and find a free address of the family (if possible), marking it
+// as allocated to the owner (e.g. the UID of a service). The address is picked according to the pool
+// Strategy.
+func (a *Allocator) Allocate(p Pool, family Family, owner string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ap, err := a.pool(p)
+	if err != nil {
+		return "", err
+	}
+
+	var ranges []addrRange
+	for _, r := range ap.ranges {
+		if r.family == family {
+			ranges = append(ranges, r)
+		}
+	}
+
+	// Pick where the search starts, it then walks the ranges (incrementally and wrapping around) until
+	// a host that is unused is found
+	var start *big.Int
+	switch p.Strategy {
+	case RoundRobin:
+		start = ap.next[family]
+	case Random:
+		start = a.randomAddress(ranges)
+	}
+	ip, host := a.firstFree(ranges, start, nil)
+	if ip == nil && start != nil {
+		ip, host = a.firstFree(ranges, nil, start)
+	}
+	if ip == nil {
+		// If we have not returned an address then we've expired the pool
+		return "", fmt.Errorf("No %s addresses available in pool [%s]", family, p.Name)
+	}
+
+	a.allocated[host] = owner
+	ap.next[family] = ip.Add(ip, big.NewInt(1))
+	return host, nil
+}
+
+// firstFree returns the lowest unallocated address of the ranges that is in [from, to), a nil from or to
+// leaves that end unbounded. The caller must hold a.mu.
+func (a *Allocator) firstFree(ranges []addrRange, from, to *big.Int) (*big.Int, string) {
+	for _, r := range ranges {
+		ip := new(big.Int).Set(r.first)
+		if from != nil && from.Cmp(ip) > 0 {
+			ip.Set(from)
+		}
+		for ; ip.Cmp(r.last) <= 0; ip.Add(ip, big.NewInt(1)) {
+			if to != nil && ip.Cmp(to) >= 0 {
+				return nil, ""
 			}
-			// TODO - currently we search (incrementally) through the list of hosts
-			for y := range Manager[x].hosts {
-				// find a host that is marked false (i.e. unused)
-				if Manager[x].addressManager[Manager[x].hosts[y]] == false {
-					// Mark it to used
-					Manager[x].addressManager[Manager[x].hosts[y]] = true
-					return Manager[x].hosts[y], nil
-				}
+			host := intToIP(ip, r.family).String()
+			if _, used := a.allocated[host]; !used {
+				return ip, host
 			}
-			// If we have found the manager for this namespace and not returned an address then we've expired the range
-			return "", fmt.Errorf("No addresses available in [%s] range [%s]", namespace, ipRange)
+		}
+	}
+	return nil, ""
+}
 
+// randomAddress returns an address of the ranges picked at random, or nil if there are no addresses. The
+// caller must hold a.mu.
+func (a *Allocator) randomAddress(ranges []addrRange) *big.Int {
+	total := big.NewInt(0)
+	for _, r := range ranges {
+		total.Add(total, r.size())
+	}
+	if total.Sign() == 0 {
+		return nil
+	}
+	offset := new(big.Int).Rand(a.rand, total)
+	for _, r := range ranges {
+		if offset.Cmp(r.size()) < 0 {
+			return offset.Add(offset, r.first)
 		}
+		offset.Sub(offset, r.size())
 	}
-	ah, err := buildHostsFromRange(ipRange)
+	return nil
+}
+
+// AllocateSpecific - marks a specific address as allocated to the owner, it fails if the address is already
+// allocated or (when a pool is passed) isn't part of the pool
+func (a *Allocator) AllocateSpecific(address string, p *Pool, owner string) error {
+	host, err := normalise(address)
 	if err != nil {
-		return "", err
+		return err
 	}
-	// If it doesn't exist then it will need adding
-	newManager := ipManager{
-		namespace:      namespace,
-		addressManager: make(map[string]bool),
-		hosts:          ah,
-		ipRange:        ipRange,
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if p != nil {
+		ap, err := a.pool(*p)
+		if err != nil {
+			return err
+		}
+		if !ap.contains(host) {
+			return fmt.Errorf("Address [%s] isn't part of pool [%s]", host, p.Name)
+		}
+	}
+	if _, used := a.allocated[host]; used {
+		return fmt.Errorf("Address [%s] is already allocated", host)
+	}
+	a.allocated[host] = owner
+	return nil
+}
+
+// InPool - returns true if the address is one of the pool addresses (whether allocated or not)
+func (a *Allocator) InPool(address string, p Pool) (bool, error) {
+	host, err := normalise(address)
+	if err != nil {
+		return false, err
 	}
-	Manager = append(Manager, newManager)
 
-	for x := range newManager.hosts {
-		if Manager[x].addressManager[newManager.hosts[x]] == false {
-			Manager[x].addressManager[newManager.hosts[x]] = true
-			return newManager.hosts[x], nil
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ap, err := a.pool(p)
+	if err != nil {
+		return false, err
+	}
+	return ap.contains(host), nil
+}
+
+// Excluded - returns true if the address is excluded from the pool
+func (a *Allocator) Excluded(address string, p Pool) (bool, error) {
+	host, err := normalise(address)
+	if err != nil {
+		return false, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ap, err := a.pool(p)
+	if err != nil {
+		return false, err
+	}
+	return inRanges(ap.excluded, host), nil
+}
+
+// Usage - returns the number of addresses the pool can hand out and how many of them are allocated
+func (a *Allocator) Usage(p Pool) (capacity, used *big.Int, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ap, err := a.pool(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	capacity = big.NewInt(0)
+	for _, r := range ap.ranges {
+		capacity.Add(capacity, r.size())
+	}
+	used = big.NewInt(0)
+	for host := range a.allocated {
+		if ap.contains(host) {
+			used.Add(used, big.NewInt(1))
 		}
 	}
-	return "", fmt.Errorf("No addresses available in [%s] range [%s]", namespace, ipRange)
+	return capacity, used, nil
+}
 
+// Allocated - returns the owner of every allocated address of the pool, by address
+func (a *Allocator) Allocated(p Pool) (map[string]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	ap, err := a.pool(p)
+	if err != nil {
+		return nil, err
+	}
+	allocated := map[string]string{}
+	for host, owner := range a.allocated {
+		if ap.contains(host) {
+			allocated[host] = owner
+		}
+	}
+	return allocated, nil
 }
 
-// FindAvailableHostFromCidr - will look through the cidr and the address Manager and find a free address (if possible)
-func FindAvailableHostFromCidr(namespace, cidr string) (string, error) {
+// Release - removes the mark on an address
+func (a *Allocator) Release(address string) error {
+	host, err := normalise(address)
+	if err != nil {
+		return err
+	}
 
-	// Look through namespaces and update one if it exists
-	for x := range Manager {
-		if Manager[x].namespace == namespace {
-			// Check that the address range is the same
-			if Manager[x].cidr != cidr {
-				// If not rebuild the available hosts
-				ah, err := buildHostsFromCidr(cidr)
-				if err != nil {
-					return "", err
-				}
-				Manager[x].hosts = ah
-			}
-			// TODO - currently we search (incrementally) through the list of hosts
-			for y := range Manager[x].hosts {
-				// find a host that is marked false (i.e. unused)
-				if Manager[x].addressManager[Manager[x].hosts[y]] == false {
-					// Mark it to used
-					Manager[x].addressManager[Manager[x].hosts[y]] = true
-					return Manager[x].hosts[y], nil
-				}
-			}
-			// If we have found the manager for this namespace and not returned an address then we've expired the range
-			return "", fmt.Errorf("No addresses available in [%s] range [%s]", namespace, cidr)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, used := a.allocated[host]; !used {
+		return fmt.Errorf("Unable to release address [%s], it isn't allocated", host)
+	}
+	delete(a.allocated, host)
+	return nil
+}
+
+// IsAllocated - returns true if the address has been allocated
+func (a *Allocator) IsAllocated(address string) bool {
+	host, err := normalise(address)
+	if err != nil {
+		return false
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	_, used := a.allocated[host]
+	return used
+}
+
+// Owner - returns the owner the address is allocated to, false if the address isn't allocated
+func (a *Allocator) Owner(address string) (string, bool) {
+	host, err := normalise(address)
+	if err != nil {
+		return "", false
+	}
 
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	owner, used := a.allocated[host]
+	return owner, used
+}
+
+// pool returns the state for the Pool, (re)building its ranges if it's new or its definition has changed.
+// The caller must hold a.mu.
+func (a *Allocator) pool(p Pool) (*pool, error) {
+	if ap, ok := a.pools[p.Name]; ok && ap.Pool == p {
+		return ap, nil
+	}
+
+	switch p.Strategy {
+	case "", LowestFree, Random, RoundRobin:
+	default:
+		return nil, fmt.Errorf("Pool [%s] has an unknown allocation strategy [%s]", p.Name, p.Strategy)
+	}
+
+	if p.CIDR == "" && p.Range == "" {
+		return nil, fmt.Errorf("Pool [%s] has neither a cidr or a range", p.Name)
+	}
+	var ranges []addrRange
+	if p.CIDR != "" {
+		cidrRanges, err := buildHostsFromCidr(p.CIDR)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, cidrRanges...)
+	}
+	if p.Range != "" {
+		rangeRanges, err := buildHostsFromRange(p.Range)
+		if err != nil {
+			return nil, err
 		}
+		ranges = append(ranges, rangeRanges...)
 	}
-	ah, err := buildHostsFromCidr(cidr)
+	excluded, err := buildExcludedRanges(p.Exclude)
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("Pool [%s] exclusions : %v", p.Name, err)
 	}
-	// If it doesn't exist then it will need adding
-	newManager := ipManager{
-		namespace:      namespace,
-		addressManager: make(map[string]bool),
-		hosts:          ah,
-		cidr:           cidr,
+
+	ap := &pool{
+		Pool:     p,
+		ranges:   excludeRanges(mergeRanges(ranges), excluded),
+		excluded: excluded,
+		next:     map[Family]*big.Int{},
 	}
-	Manager = append(Manager, newManager)
+	a.pools[p.Name] = ap
+	return ap, nil
+}
 
-	for x := range newManager.hosts {
-		if Manager[x].addressManager[newManager.hosts[x]] == false {
-			Manager[x].addressManager[newManager.hosts[x]] = true
-			return newManager.hosts[x], nil
+// size returns the number of addresses in the range
+func (r addrRange) size() *big.Int {
+	size := new(big.Int).Sub(r.last, r.first)
+	return size.Add(size, big.NewInt(1))
+}
+
+// mergeRanges sorts the ranges (IPv4 first, then by address) and merges the ones that overlap or are
+// adjacent, so that addresses are handed out in order and only once
+func mergeRanges(ranges []addrRange) []addrRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		if ranges[i].family != ranges[j].family {
+			return ranges[i].family == IPv4
+		}
+		return ranges[i].first.Cmp(ranges[j].first) < 0
+	})
+
+	var merged []addrRange
+	for _, r := range ranges {
+		if n := len(merged); n != 0 {
+			last := &merged[n-1]
+			next := new(big.Int).Add(last.last, big.NewInt(1))
+			if last.family == r.family && r.first.Cmp(next) <= 0 {
+				if r.last.Cmp(last.last) > 0 {
+					last.last = new(big.Int).Set(r.last)
+				}
+				continue
+			}
+		}
+		merged = append(merged, addrRange{family: r.family, first: new(big.Int).Set(r.first), last: new(big.Int).Set(r.last)})
+	}
+	return merged
+}
+
+// excludeRanges returns the ranges without the excluded addresses
+func excludeRanges(ranges, excluded []addrRange) []addrRange {
+	for _, ex := range excluded {
+		var remaining []addrRange
+		for _, r := range ranges {
+			if r.family != ex.family || ex.last.Cmp(r.first) < 0 || ex.first.Cmp(r.last) > 0 {
+				remaining = append(remaining, r)
+				continue
+			}
+			// Keep whatever is left either side of the exclusion
+			if r.first.Cmp(ex.first) < 0 {
+				remaining = append(remaining, addrRange{family: r.family, first: r.first, last: new(big.Int).Sub(ex.first, big.NewInt(1))})
+			}
+			if r.last.Cmp(ex.last) > 0 {
+				remaining = append(remaining, addrRange{family: r.family, first: new(big.Int).Add(ex.last, big.NewInt(1)), last: r.last})
+			}
 		}
+		ranges = remaining
 	}
-	return "", fmt.Errorf("No addresses available in [%s] range [%s]", namespace, cidr)
+	return ranges
+}
 
+// contains returns true if the host is one of the pool addresses
+func (p *pool) contains(host string) bool {
+	return inRanges(p.ranges, host)
 }
 
-// ReleaseAddress - removes the mark on an address
-func ReleaseAddress(namespace, address string) error {
-	for x := range Manager {
-		if Manager[x].namespace == namespace {
-			Manager[x].addressManager[address] = false
-			return nil
+// inRanges returns true if the host is in one of the ranges
+func inRanges(ranges []addrRange, host string) bool {
+	ip, family := ipToInt(net.ParseIP(host))
+	for _, r := range ranges {
+		if r.family == family && r.first.Cmp(ip) <= 0 && ip.Cmp(r.last) <= 0 {
+			return true
 		}
 	}
-	return fmt.Errorf("Unable to release address [%s] in namespace [%s]", address, namespace)
+	return false
 }
 
-// buildHostsFromCidr - Builds a list of addresses in the cidr
-func buildHostsFromCidr(cidr string) ([]string, error) {
-	var ips []string
+// FamilyOf - returns the family of an address
+func FamilyOf(address string) (Family, error) {
+	ip := net.ParseIP(strings.TrimSpace(address))
+	if ip == nil {
+		return "", fmt.Errorf("Unable to parse IP address [%s]", address)
+	}
+	_, family := ipToInt(ip)
+	return family, nil
+}
 
-	// Split the ipranges (comma seperated)
+// normalise returns the canonical string form of an address
+func normalise(address string) (string, error) {
+	ip := net.ParseIP(strings.TrimSpace(address))
+	if ip == nil {
+		return "", fmt.Errorf("Unable to parse IP address [%s]", address)
+	}
+	return ip.String(), nil
+}
+
+// buildHostsFromCidr - Builds the ranges of host addresses in the cidrs (comma seperated), the network
+// and broadcast addresses of IPv4 cidrs and the subnet-router address of IPv6 cidrs are left out
+func buildHostsFromCidr(cidr string) ([]addrRange, error) {
+	var ranges []addrRange
+
+	// Split the cidrs (comma seperated)
 	cidrs := strings.Split(cidr, ",")
 	if len(cidrs) == 0 {
 		return nil, fmt.Errorf("Unable to parse IP cidrs [%s]", cidr)
 	}
 
 	for x := range cidrs {
-
-		ip, ipnet, err := net.ParseCIDR(cidrs[x])
+		_, ipnet, err := net.ParseCIDR(strings.TrimSpace(cidrs[x]))
 		if err != nil {
 			return nil, err
 		}
 
-		var cidrips []string
-		for ip := ip.Mask(ipnet.Mask); ipnet.Contains(ip); inc(ip) {
-			cidrips = append(cidrips, ip.String())
-		}
+		first, family := ipToInt(ipnet.IP)
+		ones, bits := ipnet.Mask.Size()
+		size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+		last := new(big.Int).Add(first, size)
+		last.Sub(last, big.NewInt(1))
 
-		// remove network address and broadcast address
-		lenIPs := len(cidrips)
 		switch {
-		case lenIPs < 2:
-			ips = append(ips, cidrips...)
-
+		case size.Cmp(big.NewInt(2)) < 0:
+			// single address, nothing to remove
+		case family == IPv4:
+			// remove network address and broadcast address
+			first.Add(first, big.NewInt(1))
+			last.Sub(last, big.NewInt(1))
 		default:
-			ips = append(ips, cidrips[1:len(cidrips)-1]...)
+			// remove the subnet-router anycast address
+			first.Add(first, big.NewInt(1))
 		}
+		if first.Cmp(last) > 0 {
+			continue
+		}
+		ranges = append(ranges, addrRange{family: family, first: first, last: last})
 	}
-	return removeDuplicateAddresses(ips), nil
+	return ranges, nil
 }
 
-// buildHostsFromRange - Builds a list of addresses in the cidr
-func buildHostsFromRange(ipRangeString string) ([]string, error) {
-	var ips []string
+// buildHostsFromRange - Builds the ranges of addresses from start-end ranges (comma seperated)
+func buildHostsFromRange(ipRangeString string) ([]addrRange, error) {
+	var ranges []addrRange
 
 	// Split the ipranges (comma seperated)
-	ranges := strings.Split(ipRangeString, ",")
-	if len(ranges) == 0 {
+	rangeStrings := strings.Split(ipRangeString, ",")
+	if len(rangeStrings) == 0 {
 		return nil, fmt.Errorf("Unable to parse IP ranges [%s]", ipRangeString)
 	}
 
-	for x := range ranges {
-		ipRange := strings.Split(ranges[x], "-")
-		// Make sure we have x.x.x.x-x.x.x.x
+	for x := range rangeStrings {
+		ipRange := strings.Split(strings.TrimSpace(rangeStrings[x]), "-")
+		// Make sure we have start-end
 		if len(ipRange) != 2 {
-			return nil, fmt.Errorf("Unable to parse IP range [%s]", ranges[x])
+			return nil, fmt.Errorf("Unable to parse IP range [%s]", rangeStrings[x])
 		}
-		startRange := net.ParseIP(ipRange[0]).To4()
-		endRange := net.ParseIP(ipRange[1]).To4()
-		//parse the ranges to make sure we don't end in a crazy loop
-		if startRange[0] > endRange[0] {
-			return nil, fmt.Errorf("First octet of start range [%d] is higher then the ending range [%d]", startRange[0], endRange[0])
+		startIP := net.ParseIP(strings.TrimSpace(ipRange[0]))
+		endIP := net.ParseIP(strings.TrimSpace(ipRange[1]))
+		if startIP == nil || endIP == nil {
+			return nil, fmt.Errorf("Unable to parse IP range [%s]", rangeStrings[x])
 		}
-		if startRange[1] > endRange[1] {
-			return nil, fmt.Errorf("Second octet of start range [%d] is higher then the ending range [%d]", startRange[1], endRange[1])
+		first, startFamily := ipToInt(startIP)
+		last, endFamily := ipToInt(endIP)
+		if startFamily != endFamily {
+			return nil, fmt.Errorf("Start [%s] and end [%s] of range are different IP families", startIP, endIP)
 		}
-		ips = append(ips, startRange.String())
-
-		// Break the lowerBytes to an array
-		for !startRange.Equal(endRange) {
-			startRange[3]++
-			ips = append(ips, startRange.String())
+		//parse the ranges to make sure we don't end up with an empty range
+		if first.Cmp(last) > 0 {
+			return nil, fmt.Errorf("Start of range [%s] is higher then the end of the range [%s]", startIP, endIP)
 		}
-		klog.Infof("Rebuilding addresse cache, [%d] addresses exist", len(ips))
+		size := new(big.Int).Sub(last, first)
+		if size.Cmp(big.NewInt(maxRangeSize)) >= 0 {
+			return nil, fmt.Errorf("Range [%s] has more than %d addresses", rangeStrings[x], maxRangeSize)
+		}
+		ranges = append(ranges, addrRange{family: startFamily, first: first, last: last})
 	}
-	return removeDuplicateAddresses(ips), nil
+	return ranges, nil
 }
 
-func removeDuplicateAddresses(arr []string) []string {
-	addresses := map[string]bool{}
-	uniqueAddresses := []string{} // Keep all keys from the map into a slice.
+// buildExcludedRanges - Builds the ranges of excluded addresses from addresses, cidrs or start-end ranges
+// (comma seperated), unlike a pool cidr every address of an excluded cidr is excluded
+func buildExcludedRanges(exclude string) ([]addrRange, error) {
+	var ranges []addrRange
+	if strings.TrimSpace(exclude) == "" {
+		return nil, nil
+	}
 
-	for i := range arr {
-		addresses[arr[i]] = true
+	for _, entry := range strings.Split(exclude, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case strings.Contains(entry, "/"):
+			_, ipnet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, err
+			}
+			first, family := ipToInt(ipnet.IP)
+			ones, bits := ipnet.Mask.Size()
+			last := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+			last.Add(last, first)
+			last.Sub(last, big.NewInt(1))
+			ranges = append(ranges, addrRange{family: family, first: first, last: last})
+		case strings.Contains(entry, "-"):
+			r, err := buildHostsFromRange(entry)
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, r...)
+		default:
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("Unable to parse IP address [%s]", entry)
+			}
+			first, family := ipToInt(ip)
+			ranges = append(ranges, addrRange{family: family, first: first, last: new(big.Int).Set(first)})
+		}
 	}
-	for j := range addresses {
-		uniqueAddresses = append(uniqueAddresses, j)
+	return ranges, nil
+}
+
+// ipToInt returns the address as an integer along with its family
+func ipToInt(ip net.IP) (*big.Int, Family) {
+	if v4 := ip.To4(); v4 != nil {
+		return new(big.Int).SetBytes(v4), IPv4
 	}
-	return uniqueAddresses
+	return new(big.Int).SetBytes(ip.To16()), IPv6
 }
 
-func inc(ip net.IP) {
-	for j := len(ip) - 1; j >= 0; j-- {
-		ip[j]++
-		if ip[j] > 0 {
-			break
-		}
+// intToIP returns the address of the family for the integer
+func intToIP(i *big.Int, family Family) net.IP {
+	size := net.IPv4len
+	if family == IPv6 {
+		size = net.IPv6len
 	}
+	b := i.Bytes()
+	ip := make(net.IP, size)
+	copy(ip[size-len(b):], b)
+	return ip
 }
@@ -1,7 +1,9 @@
 package ipam
 
 import (
+	"math/big"
 	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -47,6 +49,80 @@ func Test_buildHostsFromRange(t *testing.T) {
 			want:    []string{"192.168.0.10", "192.168.0.11", "192.168.0.12", "192.168.0.13"},
 			wantErr: false,
 		},
+		{
+			name: "ipv6 range",
+			args: args{
+				"fd00::fe-fd00::101",
+			},
+			want:    []string{"fd00::fe", "fd00::ff", "fd00::100", "fd00::101"},
+			wantErr: false,
+		},
+		{
+			name: "dual stack ranges",
+			args: args{
+				"192.168.0.10-192.168.0.11,fd00::10-fd00::11",
+			},
+			want:    []string{"192.168.0.10", "192.168.0.11", "fd00::10", "fd00::11"},
+			wantErr: false,
+		},
+		{
+			name: "range across octets",
+			args: args{
+				"192.168.0.254-192.168.1.1",
+			},
+			want:    []string{"192.168.0.254", "192.168.0.255", "192.168.1.0", "192.168.1.1"},
+			wantErr: false,
+		},
+		{
+			name: "range across the third octet",
+			args: args{
+				"10.0.0.250-10.0.1.5",
+			},
+			want:    []string{"10.0.0.250", "10.0.0.251", "10.0.0.252", "10.0.0.253", "10.0.0.254", "10.0.0.255", "10.0.1.0", "10.0.1.1", "10.0.1.2", "10.0.1.3", "10.0.1.4", "10.0.1.5"},
+			wantErr: false,
+		},
+		{
+			name: "reversed range",
+			args: args{
+				"192.168.0.12-192.168.0.10",
+			},
+			wantErr: true,
+		},
+		{
+			name: "excessively large range",
+			args: args{
+				"10.0.0.0-11.0.0.0",
+			},
+			wantErr: true,
+		},
+		{
+			name: "excessively large ipv6 range",
+			args: args{
+				"fd00::-fd00::1:0:0",
+			},
+			wantErr: true,
+		},
+		{
+			name: "mixed families",
+			args: args{
+				"192.168.0.10-fd00::10",
+			},
+			wantErr: true,
+		},
+		{
+			name: "missing end",
+			args: args{
+				"192.168.0.10",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid address",
+			args: args{
+				"192.168.0.10-192.168.0.256",
+			},
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -55,8 +131,8 @@ func Test_buildHostsFromRange(t *testing.T) {
 				t.Errorf("buildHostsFromRange() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("buildHostsFromRange() = %v, want %v", got, tt.want)
+			if hosts := allocationOrder(got); !reflect.DeepEqual(hosts, tt.want) {
+				t.Errorf("buildHostsFromRange() = %v, want %v", hosts, tt.want)
 			}
 		})
 	}
@@ -88,6 +164,14 @@ func Test_buildHostsFromCidr(t *testing.T) {
 			want:    []string{"192.168.0.201", "192.168.0.202", "192.168.0.203", "192.168.0.204", "192.168.0.205", "192.168.0.206"},
 			wantErr: false,
 		},
+		{
+			name: "ipv6 entry",
+			args: args{
+				"fd00::/126",
+			},
+			want:    []string{"fd00::1", "fd00::2", "fd00::3"},
+			wantErr: false,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -96,9 +180,426 @@ func Test_buildHostsFromCidr(t *testing.T) {
 				t.Errorf("buildHostsFromCidr() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("buildHostsFromCidr() = %v, want %v", got, tt.want)
+			if hosts := allocationOrder(got); !reflect.DeepEqual(hosts, tt.want) {
+				t.Errorf("buildHostsFromCidr() = %v, want %v", hosts, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllocator_Allocate(t *testing.T) {
+	a := NewAllocator()
+	p := Pool{Name: "cidr-default", CIDR: "192.168.0.200/30"}
+
+	var got []string
+	for i := 0; i < 2; i++ {
+		address, err := a.Allocate(p, IPv4, "")
+		if err != nil {
+			t.Fatalf("Allocate() error = %v", err)
+		}
+		got = append(got, address)
+	}
+	if want := []string{"192.168.0.201", "192.168.0.202"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Allocate() = %v, want %v", got, want)
+	}
+	if _, err := a.Allocate(p, IPv4, ""); err == nil {
+		t.Errorf("Allocate() expected the pool to be exhausted")
+	}
+
+	if err := a.Release("192.168.0.201"); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	if a.IsAllocated("192.168.0.201") {
+		t.Errorf("IsAllocated() = true after Release()")
+	}
+	if err := a.Release("192.168.0.201"); err == nil {
+		t.Errorf("Release() expected an error for a free address")
+	}
+	if address, err := a.Allocate(p, IPv4, ""); err != nil || address != "192.168.0.201" {
+		t.Errorf("Allocate() = %s, %v, want the released address", address, err)
+	}
+}
+
+func TestAllocator_dualStack(t *testing.T) {
+	a := NewAllocator()
+	// A /64 has far too many hosts to enumerate, the addresses must be found lazily
+	p := Pool{Name: "cidr-global", CIDR: "192.168.0.200/30,fd00:10::/64"}
+
+	tests := []struct {
+		family Family
+		want   string
+	}{
+		{family: IPv6, want: "fd00:10::1"},
+		{family: IPv4, want: "192.168.0.201"},
+		{family: IPv6, want: "fd00:10::2"},
+	}
+	for _, tt := range tests {
+		got, err := a.Allocate(p, tt.family, "")
+		if err != nil {
+			t.Fatalf("Allocate(%s) error = %v", tt.family, err)
+		}
+		if got != tt.want {
+			t.Errorf("Allocate(%s) = %s, want %s", tt.family, got, tt.want)
+		}
+	}
+
+	if err := a.AllocateSpecific("fd00:10::ffff:ffff:ffff:ffff", &p, ""); err != nil {
+		t.Errorf("AllocateSpecific() error = %v", err)
+	}
+	if err := a.AllocateSpecific("fd00:11::1", &p, ""); err == nil {
+		t.Errorf("AllocateSpecific() expected an error for an address outside of the pool")
+	}
+	if _, err := a.Allocate(Pool{Name: "cidr-v4", CIDR: "192.168.0.200/30"}, IPv6, ""); err == nil {
+		t.Errorf("Allocate() expected an error for a pool without IPv6 addresses")
+	}
+}
+
+// allocationOrder returns the addresses of the ranges in the order they're handed out
+func allocationOrder(ranges []addrRange) []string {
+	var hosts []string
+	seen := map[string]bool{}
+	for _, r := range ranges {
+		for ip := new(big.Int).Set(r.first); ip.Cmp(r.last) <= 0; ip.Add(ip, big.NewInt(1)) {
+			host := intToIP(ip, r.family).String()
+			if !seen[host] {
+				seen[host] = true
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return hosts
+}
+
+func TestAllocator_lowestFree(t *testing.T) {
+	a := NewAllocator()
+	// The ranges are out of order and overlap, addresses are still handed out lowest first
+	p := Pool{Name: "range-global", Range: "192.168.0.20-192.168.0.21,192.168.0.10-192.168.0.11,192.168.0.11-192.168.0.12"}
+	want := []string{"192.168.0.10", "192.168.0.11", "192.168.0.12", "192.168.0.20", "192.168.0.21"}
+
+	for i := 0; i < 3; i++ {
+		var got []string
+		for range want {
+			address, err := a.Allocate(p, IPv4, "")
+			if err != nil {
+				t.Fatalf("Allocate() error = %v", err)
+			}
+			got = append(got, address)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Allocate() = %v, want %v", got, want)
+		}
+		for _, address := range got {
+			a.Release(address)
+		}
+	}
+}
+
+func TestAllocator_roundRobin(t *testing.T) {
+	a := NewAllocator()
+	p := Pool{Name: "range-global", Range: "192.168.0.10-192.168.0.13", Strategy: RoundRobin}
+
+	allocate := func() string {
+		address, err := a.Allocate(p, IPv4, "")
+		if err != nil {
+			t.Fatalf("Allocate() error = %v", err)
+		}
+		return address
+	}
+	first := allocate()
+	second := allocate()
+	if err := a.Release(first); err != nil {
+		t.Fatal(err)
+	}
+	// The released address isn't reused until the end of the pool has been reached
+	var got []string
+	for i := 0; i < 3; i++ {
+		got = append(got, allocate())
+	}
+	if want := []string{"192.168.0.12", "192.168.0.13", first}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Allocate() = %v, want %v (after %s, %s)", got, want, first, second)
+	}
+	if _, err := a.Allocate(p, IPv4, ""); err == nil {
+		t.Errorf("Allocate() expected the pool to be exhausted")
+	}
+}
+
+func TestAllocator_random(t *testing.T) {
+	a := NewAllocator()
+	p := Pool{Name: "cidr-global", CIDR: "10.0.0.0/24", Strategy: Random}
+
+	seen := map[string]bool{}
+	for i := 0; i < 254; i++ {
+		address, err := a.Allocate(p, IPv4, "")
+		if err != nil {
+			t.Fatalf("Allocate() error = %v", err)
+		}
+		if seen[address] {
+			t.Fatalf("address [%s] allocated twice", address)
+		}
+		seen[address] = true
+	}
+	if _, err := a.Allocate(p, IPv4, ""); err == nil {
+		t.Errorf("Allocate() expected the pool to be exhausted")
+	}
+}
+
+func TestAllocator_unknownStrategy(t *testing.T) {
+	a := NewAllocator()
+	if _, err := a.Allocate(Pool{Name: "cidr-global", CIDR: "10.0.0.0/24", Strategy: "fastest"}, IPv4, ""); err == nil {
+		t.Errorf("Allocate() expected an error for an unknown strategy")
+	}
+}
+
+func TestAllocator_exclude(t *testing.T) {
+	a := NewAllocator()
+	p := Pool{
+		Name:    "cidr-global",
+		CIDR:    "192.168.0.0/28,fd00::/124",
+		Exclude: "192.168.0.1, 192.168.0.4-192.168.0.6,192.168.0.8/30,fd00::1",
+	}
+
+	var got []string
+	for {
+		address, err := a.Allocate(p, IPv4, "")
+		if err != nil {
+			break
+		}
+		got = append(got, address)
+	}
+	if want := []string{"192.168.0.2", "192.168.0.3", "192.168.0.7", "192.168.0.12", "192.168.0.13", "192.168.0.14"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Allocate() = %v, want %v", got, want)
+	}
+	if address, err := a.Allocate(p, IPv6, ""); err != nil || address != "fd00::2" {
+		t.Errorf("Allocate(IPv6) = %s, %v, want fd00::2", address, err)
+	}
+
+	tests := []struct {
+		address      string
+		wantExcluded bool
+		wantInPool   bool
+	}{
+		{address: "192.168.0.5", wantExcluded: true},
+		{address: "192.168.0.11", wantExcluded: true},
+		{address: "192.168.0.2", wantInPool: true},
+	}
+	for _, tt := range tests {
+		if excluded, _ := a.Excluded(tt.address, p); excluded != tt.wantExcluded {
+			t.Errorf("Excluded(%s) = %v, want %v", tt.address, excluded, tt.wantExcluded)
+		}
+		if inPool, _ := a.InPool(tt.address, p); inPool != tt.wantInPool {
+			t.Errorf("InPool(%s) = %v, want %v", tt.address, inPool, tt.wantInPool)
+		}
+	}
+	if err := a.AllocateSpecific("192.168.0.5", &p, ""); err == nil {
+		t.Errorf("AllocateSpecific() expected an error for an excluded address")
+	}
+
+	if _, err := a.Allocate(Pool{Name: "cidr-bad", CIDR: "10.0.0.0/24", Exclude: "10.0.0"}, IPv4, ""); err == nil {
+		t.Errorf("Allocate() expected an error for an invalid exclusion")
+	}
+}
+
+func TestAllocator_Usage(t *testing.T) {
+	a := NewAllocator()
+	p := Pool{Name: "cidr-global", CIDR: "192.168.0.0/29", Exclude: "192.168.0.1"}
+	a.Allocate(p, IPv4, "")
+	a.AllocateSpecific("10.0.0.1", nil, "")
+
+	capacity, used, err := a.Usage(p)
+	if err != nil {
+		t.Fatalf("Usage() error = %v", err)
+	}
+	if capacity.Int64() != 5 || used.Int64() != 1 {
+		t.Errorf("Usage() = %s, %s, want 5, 1", capacity, used)
+	}
+
+	capacity, _, err = a.Usage(Pool{Name: "cidr-v6", CIDR: "fd00::/64"})
+	if err != nil {
+		t.Fatalf("Usage() error = %v", err)
+	}
+	if want := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 64), big.NewInt(1)); capacity.Cmp(want) != 0 {
+		t.Errorf("Usage() capacity = %s, want %s", capacity, want)
+	}
+}
+
+func TestAllocator_sharedAcrossPools(t *testing.T) {
+	a := NewAllocator()
+	first, err := a.Allocate(Pool{Name: "cidr-default", CIDR: "192.168.0.200/30"}, IPv4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := a.Allocate(Pool{Name: "range-global", Range: "192.168.0.201-192.168.0.202"}, IPv4, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Errorf("overlapping pools handed out [%s] twice", first)
+	}
+}
+
+func TestAllocator_Owner(t *testing.T) {
+	a := NewAllocator()
+	address, err := a.Allocate(Pool{Name: "cidr-global", CIDR: "192.168.0.200/30"}, IPv4, "web-uid")
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	if err := a.AllocateSpecific("fd00::10", nil, "api-uid"); err != nil {
+		t.Fatalf("AllocateSpecific() error = %v", err)
+	}
+	for address, want := range map[string]string{address: "web-uid", "fd00:0::10": "api-uid"} {
+		if owner, ok := a.Owner(address); !ok || owner != want {
+			t.Errorf("Owner(%s) = %s, %v, want %s", address, owner, ok, want)
+		}
+	}
+	a.Release(address)
+	if owner, ok := a.Owner(address); ok {
+		t.Errorf("Owner(%s) = %s after Release()", address, owner)
+	}
+}
+
+func TestAllocator_Allocated(t *testing.T) {
+	a := NewAllocator()
+	p := Pool{Name: "cidr-global", CIDR: "192.168.0.200/30"}
+	address, err := a.Allocate(p, IPv4, "web-uid")
+	if err != nil {
+		t.Fatalf("Allocate() error = %v", err)
+	}
+	// An address outside of the pool isn't listed
+	if err := a.AllocateSpecific("10.0.0.1", nil, "api-uid"); err != nil {
+		t.Fatalf("AllocateSpecific() error = %v", err)
+	}
+	allocated, err := a.Allocated(p)
+	if want := map[string]string{address: "web-uid"}; err != nil || !reflect.DeepEqual(allocated, want) {
+		t.Errorf("Allocated() = %v, %v, want %v", allocated, err, want)
+	}
+}
+
+func TestAllocator_AllocateSpecific(t *testing.T) {
+	p := &Pool{Name: "range-default", Range: "192.168.0.10-192.168.0.12"}
+	tests := []struct {
+		name    string
+		address string
+		pool    *Pool
+		wantErr bool
+	}{
+		{
+			name:    "address in pool",
+			address: "192.168.0.11",
+			pool:    p,
+		},
+		{
+			name:    "address already allocated",
+			address: "192.168.0.10",
+			pool:    p,
+			wantErr: true,
+		},
+		{
+			name:    "address outside pool",
+			address: "192.168.0.20",
+			pool:    p,
+			wantErr: true,
+		},
+		{
+			name:    "address without a pool",
+			address: "10.0.0.1",
+		},
+		{
+			name:    "invalid address",
+			address: "192.168.0",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAllocator()
+			if err := a.AllocateSpecific("192.168.0.10", nil, ""); err != nil {
+				t.Fatal(err)
+			}
+			err := a.AllocateSpecific(tt.address, tt.pool, "")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("AllocateSpecific() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !a.IsAllocated(tt.address) {
+				t.Errorf("IsAllocated() = false after AllocateSpecific()")
 			}
 		})
 	}
 }
+
+func TestAllocator_parallel(t *testing.T) {
+	a := NewAllocator()
+	p := Pool{Name: "cidr-global", CIDR: "10.0.0.0/24"}
+
+	var wg sync.WaitGroup
+	results := make(chan string, 300)
+	for i := 0; i < 300; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			address, err := a.Allocate(p, IPv4, "")
+			if err != nil {
+				return
+			}
+			results <- address
+			if !a.IsAllocated(address) {
+				t.Errorf("IsAllocated(%s) = false", address)
+			}
+		}()
+	}
+	wg.Wait()
+	close(results)
+
+	seen := map[string]bool{}
+	for address := range results {
+		if seen[address] {
+			t.Errorf("address [%s] allocated twice", address)
+		}
+		seen[address] = true
+	}
+	if len(seen) != 254 {
+		t.Errorf("allocated %d addresses, want 254", len(seen))
+	}
+
+	// Release and re-allocate concurrently
+	for address := range seen {
+		wg.Add(2)
+		go func(address string) {
+			defer wg.Done()
+			if err := a.Release(address); err != nil {
+				t.Error(err)
+			}
+		}(address)
+		go func() {
+			defer wg.Done()
+			a.Allocate(p, IPv4, "")
+		}()
+	}
+	wg.Wait()
+}
+
+func TestAllocator_InPool(t *testing.T) {
+	a := NewAllocator()
+	p := Pool{Name: "cidr-default", CIDR: "192.168.0.200/29"}
+	tests := []struct {
+		address string
+		want    bool
+		wantErr bool
+	}{
+		{address: "192.168.0.201", want: true},
+		{address: "192.168.0.200", want: false},
+		{address: "192.168.1.201", want: false},
+		{address: "not-an-address", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := a.InPool(tt.address, p)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("InPool(%s) error = %v, wantErr %v", tt.address, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("InPool(%s) = %v, want %v", tt.address, got, tt.want)
+		}
+	}
+	if a.IsAllocated("192.168.0.201") {
+		t.Errorf("InPool() allocated the address")
+	}
+}
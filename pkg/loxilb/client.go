@@ -0,0 +1,99 @@
+package loxilb
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// DefaultPort is the port the LoxiLB REST API listens on
+	DefaultPort = 11111
+
+	// apiPrefix is prepended to every LoxiLB API path
+	apiPrefix = "/netlox/v1"
+)
+
+// Client talks to the REST API of a single LoxiLB instance
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+}
+
+// NewClient returns a client for the LoxiLB API found at endpoint (e.g. http://10.0.0.1:11111).
+// If httpClient is nil then http.DefaultClient is used.
+func NewClient(endpoint string, httpClient *http.Client) (*Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse LoxiLB endpoint [%s] : %v", endpoint, err)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("LoxiLB endpoint [%s] must be of the form scheme://host:port", endpoint)
+	}
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{
+		baseURL:    u,
+		httpClient: httpClient,
+	}, nil
+}
+
+// Endpoint returns the address of the LoxiLB API this client talks to
+func (c *Client) Endpoint() string {
+	return c.baseURL.String()
+}
+
+// do sends a request to the LoxiLB API, encoding in as the request body (if not nil) and decoding the
+// response into out (if not nil). Any non-2xx response is returned as an *Error.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	u := *c.baseURL
+	u.Path = strings.TrimSuffix(u.Path, "/") + apiPrefix + path
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return decodeError(resp.StatusCode, b)
+	}
+
+	if out == nil || len(b) == 0 {
+		return nil
+	}
+	if err = json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("Unable to decode LoxiLB response from [%s %s] : %v", method, u.Path, err)
+	}
+	return nil
+}
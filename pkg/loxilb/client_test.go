@@ -0,0 +1,203 @@
+package loxilb
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, h http.HandlerFunc) (*Client, func()) {
+	srv := httptest.NewServer(h)
+	c, err := NewClient(srv.URL, srv.Client())
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	return c, srv.Close
+}
+
+func TestClient_CreateLoadBalancer(t *testing.T) {
+	want := LoadBalancer{
+		ServiceArguments: ServiceArguments{ExternalIP: "192.168.0.201", Port: 80, Protocol: "tcp"},
+		Endpoints: []Endpoint{
+			{EndpointIP: "10.0.0.2", TargetPort: 30080, Weight: 1},
+			{EndpointIP: "10.0.0.3", TargetPort: 30080, Weight: 1},
+		},
+	}
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/netlox/v1/config/loadbalancer" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		got := LoadBalancer{}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("CreateLoadBalancer() sent %+v, want %+v", got, want)
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	defer done()
+	if err := c.CreateLoadBalancer(context.Background(), &want); err != nil {
+		t.Errorf("CreateLoadBalancer() error = %v", err)
+	}
+}
+
+func TestClient_GetLoadBalancer(t *testing.T) {
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || r.URL.Path != "/netlox/v1/config/loadbalancer/all" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		w.Write([]byte(`{"lbAttr":[
+			{"serviceArguments":{"externalIP":"192.168.0.201","port":80,"protocol":"tcp"},"endpoints":[{"endpointIP":"10.0.0.2","targetPort":30080}]},
+			{"serviceArguments":{"externalIP":"192.168.0.201","port":53,"protocol":"udp"},"endpoints":[{"endpointIP":"10.0.0.2","targetPort":30053}]}
+		]}`))
+	})
+	defer done()
+
+	got, err := c.GetLoadBalancer(context.Background(), "192.168.0.201", 53, "UDP")
+	if err != nil {
+		t.Fatalf("GetLoadBalancer() error = %v", err)
+	}
+	if got.Endpoints[0].TargetPort != 30053 {
+		t.Errorf("GetLoadBalancer() = %+v, want the udp rule", got)
+	}
+
+	_, err = c.GetLoadBalancer(context.Background(), "192.168.0.202", 80, "tcp")
+	if !IsNotFound(err) {
+		t.Errorf("GetLoadBalancer() error = %v, want not found", err)
+	}
+}
+
+func TestClient_DeleteLoadBalancer(t *testing.T) {
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		want := "/netlox/v1/config/loadbalancer/externalipaddress/192.168.0.201/port/80/protocol/tcp"
+		if r.Method != http.MethodDelete || r.URL.Path != want {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+	defer done()
+	if err := c.DeleteLoadBalancer(context.Background(), "192.168.0.201", 80, "TCP"); err != nil {
+		t.Errorf("DeleteLoadBalancer() error = %v", err)
+	}
+}
+
+func TestClient_Routes(t *testing.T) {
+	want := Route{DestinationIPNet: "10.244.1.0/24", Gateway: "10.0.0.2"}
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/netlox/v1/config/route":
+			got := Route{}
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				t.Error(err)
+			}
+			if got != want {
+				t.Errorf("CreateRoute() sent %+v, want %+v", got, want)
+			}
+		case r.Method == http.MethodGet && r.URL.Path == "/netlox/v1/config/route/all":
+			w.Write([]byte(`{"routeAttr":[{"destinationIPNet":"10.244.1.0/24","gateway":"10.0.0.2","flags":"Ind"}]}`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/netlox/v1/config/route/destinationIPNet/fd00:10:244:1::/64":
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+	})
+	defer done()
+
+	if err := c.CreateRoute(context.Background(), &want); err != nil {
+		t.Errorf("CreateRoute() error = %v", err)
+	}
+	routes, err := c.ListRoutes(context.Background())
+	if err != nil || !reflect.DeepEqual(routes, []Route{want}) {
+		t.Errorf("ListRoutes() = %+v, %v, want %+v", routes, err, want)
+	}
+	if err := c.DeleteRoute(context.Background(), "fd00:10:244:1::/64"); err != nil {
+		t.Errorf("DeleteRoute() error = %v", err)
+	}
+	if err := c.DeleteRoute(context.Background(), "10.244.1.0"); err == nil {
+		t.Errorf("DeleteRoute() expected an error for a destination that isn't a CIDR")
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		body          string
+		wantMessage   string
+		alreadyExists bool
+		notFound      bool
+	}{
+		{
+			name:        "structured error",
+			status:      http.StatusBadRequest,
+			body:        `{"code":400,"message":"malformed lb args"}`,
+			wantMessage: "malformed lb args",
+		},
+		{
+			name:          "rule exists",
+			status:        http.StatusConflict,
+			body:          `{"code":409,"message":"lb rule exists"}`,
+			wantMessage:   "lb rule exists",
+			alreadyExists: true,
+		},
+		{
+			name:          "rule exists code",
+			status:        http.StatusBadRequest,
+			body:          `{"code":409,"message":"lb rule exists"}`,
+			wantMessage:   "lb rule exists",
+			alreadyExists: true,
+		},
+		{
+			name:        "missing endpoint",
+			status:      http.StatusBadRequest,
+			body:        `{"code":400,"message":"endpoint doesn't exist"}`,
+			wantMessage: "endpoint doesn't exist",
+		},
+		{
+			name:        "plain text error",
+			status:      http.StatusNotFound,
+			body:        "no such rule\n",
+			wantMessage: "no such rule",
+			notFound:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+			defer done()
+			err := c.DeleteLoadBalancer(context.Background(), "192.168.0.201", 80, "tcp")
+			apiErr, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("DeleteLoadBalancer() error = %v, want *Error", err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Message != tt.wantMessage {
+				t.Errorf("DeleteLoadBalancer() error = %+v", apiErr)
+			}
+			if IsAlreadyExists(err) != tt.alreadyExists {
+				t.Errorf("IsAlreadyExists() = %v, want %v", IsAlreadyExists(err), tt.alreadyExists)
+			}
+			if IsNotFound(err) != tt.notFound {
+				t.Errorf("IsNotFound() = %v, want %v", IsNotFound(err), tt.notFound)
+			}
+		})
+	}
+}
+
+func TestClient_Context(t *testing.T) {
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	defer done()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.ListLoadBalancers(ctx); err == nil {
+		t.Errorf("ListLoadBalancers() expected a context error")
+	}
+}
@@ -0,0 +1,56 @@
+package loxilb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error is returned for any request that LoxiLB answers with a non-2xx status
+type Error struct {
+	// StatusCode is the HTTP status of the response
+	StatusCode int `json:"-"`
+	// Code is the error code reported by LoxiLB (if any)
+	Code int `json:"code,omitempty"`
+	// Message is the error message reported by LoxiLB (if any)
+	Message string `json:"message,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("loxilb: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("loxilb: %d %s", e.StatusCode, e.Message)
+}
+
+// decodeError builds an *Error from a response body, falling back to the raw body when LoxiLB
+// didn't return a structured error
+func decodeError(statusCode int, body []byte) error {
+	apiErr := &Error{StatusCode: statusCode}
+	if err := json.Unmarshal(body, apiErr); err != nil || (apiErr.Code == 0 && apiErr.Message == "") {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	return apiErr
+}
+
+// IsNotFound returns true if err reports that the requested object doesn't exist in LoxiLB
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusNotFound
+	}
+	return false
+}
+
+// IsAlreadyExists returns true if err reports that the object already exists in LoxiLB, either by the
+// status of the response or the error code LoxiLB reports. The message isn't matched, as other errors
+// (e.g. "endpoint doesn't exist") mention existence too.
+func IsAlreadyExists(err error) bool {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusConflict || apiErr.Code == http.StatusConflict
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+package loxilb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// LoadBalancer is a single load-balancer rule as understood by LoxiLB
+type LoadBalancer struct {
+	ServiceArguments ServiceArguments `json:"serviceArguments"`
+	Endpoints        []Endpoint       `json:"endpoints"`
+}
+
+// ServiceArguments identifies the VIP side of a load-balancer rule
+type ServiceArguments struct {
+	ExternalIP string `json:"externalIP"`
+	Port       int32  `json:"port"`
+	Protocol   string `json:"protocol"`
+	// Sel is the endpoint selection algorithm (0 is round-robin)
+	Sel int `json:"sel,omitempty"`
+}
+
+// Endpoint is a backend that traffic for a rule is forwarded to
+type Endpoint struct {
+	EndpointIP string `json:"endpointIP"`
+	TargetPort int32  `json:"targetPort"`
+	Weight     int    `json:"weight,omitempty"`
+}
+
+// loadBalancerList is the response of the LoxiLB "list all rules" endpoint
+type loadBalancerList struct {
+	Attr []LoadBalancer `json:"lbAttr"`
+}
+
+// CreateLoadBalancer creates (or updates the endpoints of) a load-balancer rule
+func (c *Client) CreateLoadBalancer(ctx context.Context, lb *LoadBalancer) error {
+	return c.do(ctx, http.MethodPost, "/config/loadbalancer", lb, nil)
+}
+
+// ListLoadBalancers returns every load-balancer rule configured in LoxiLB
+func (c *Client) ListLoadBalancers(ctx context.Context) ([]LoadBalancer, error) {
+	list := loadBalancerList{}
+	if err := c.do(ctx, http.MethodGet, "/config/loadbalancer/all", nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Attr, nil
+}
+
+// GetLoadBalancer returns the rule matching the external IP, port and protocol. An *Error with
+// a 404 status is returned if no such rule exists.
+func (c *Client) GetLoadBalancer(ctx context.Context, externalIP string, port int32, protocol string) (*LoadBalancer, error) {
+	rules, err := c.ListLoadBalancers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for x := range rules {
+		args := rules[x].ServiceArguments
+		if args.ExternalIP == externalIP && args.Port == port && strings.EqualFold(args.Protocol, protocol) {
+			return &rules[x], nil
+		}
+	}
+	return nil, &Error{
+		StatusCode: http.StatusNotFound,
+		Message:    fmt.Sprintf("no rule for %s:%d/%s", externalIP, port, protocol),
+	}
+}
+
+// DeleteLoadBalancer removes the rule matching the external IP, port and protocol
+func (c *Client) DeleteLoadBalancer(ctx context.Context, externalIP string, port int32, protocol string) error {
+	path := fmt.Sprintf("/config/loadbalancer/externalipaddress/%s/port/%d/protocol/%s", externalIP, port, strings.ToLower(protocol))
+	return c.do(ctx, http.MethodDelete, path, nil, nil)
+}
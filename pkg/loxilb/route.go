@@ -0,0 +1,45 @@
+package loxilb
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Route is a route programmed in LoxiLB, forwarding the traffic for a destination network to a gateway
+type Route struct {
+	// DestinationIPNet is the destination network in CIDR notation (e.g. 10.244.1.0/24)
+	DestinationIPNet string `json:"destinationIPNet"`
+	Gateway          string `json:"gateway"`
+}
+
+// routeList is the response of the LoxiLB "list all routes" endpoint
+type routeList struct {
+	Attr []Route `json:"routeAttr"`
+}
+
+// CreateRoute creates a route
+func (c *Client) CreateRoute(ctx context.Context, route *Route) error {
+	return c.do(ctx, http.MethodPost, "/config/route", route, nil)
+}
+
+// ListRoutes returns every route configured in LoxiLB
+func (c *Client) ListRoutes(ctx context.Context) ([]Route, error) {
+	list := routeList{}
+	if err := c.do(ctx, http.MethodGet, "/config/route/all", nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Attr, nil
+}
+
+// DeleteRoute removes the route for the destination network (in CIDR notation)
+func (c *Client) DeleteRoute(ctx context.Context, destinationIPNet string) error {
+	_, ipNet, err := net.ParseCIDR(destinationIPNet)
+	if err != nil {
+		return fmt.Errorf("Unable to parse route destination [%s] : %v", destinationIPNet, err)
+	}
+	ones, _ := ipNet.Mask.Size()
+	path := fmt.Sprintf("/config/route/destinationIPNet/%s/%d", ipNet.IP, ones)
+	return c.do(ctx, http.MethodDelete, path, nil, nil)
+}